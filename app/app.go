@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"html/template"
 	"mime"
 	"net"
@@ -12,7 +13,9 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -30,22 +33,27 @@ const (
 
 	// Send pings to client with this period. Must be less than wsPongWait.
 	wsPingPeriod = (wsPongWait * 9) / 10
+
+	// Maximum size of a message read from the client, e.g a start command with
+	// its parameters and extra arguments.
+	wsMaxMessageSize = 64 << 10
 )
 
 // this channel gets notified when process receives signal. It is global to ease unit testing
 var quit = make(chan os.Signal, 1)
 
+// ConfigLoader loads the workspaces configuration, it's used to reload the configuration
+type ConfigLoader func() (map[string]*ConfigWorkspace, error)
+
 type App struct {
 	lencak *Lencak
 	asset  func(string) ([]byte, error)
 	server *http.Server
-}
+	loader ConfigLoader
 
-type WSMessage struct {
-	Workspace string `json:"workspace"`
-	Task string `json:"task"`
-	Service bool `json:"service"`
-	Command string `json:"command"` // only start/stop supported
+	// the files the current configuration was loaded from
+	filesMu     sync.Mutex
+	configFiles []string
 }
 
 func NewApp(config map[string]*ConfigWorkspace, asset func(string) ([]byte, error)) *App {
@@ -59,14 +67,23 @@ func NewApp(config map[string]*ConfigWorkspace, asset func(string) ([]byte, erro
 	}
 
 	app := &App{
-		lencak: lencak,
-		asset:  asset,
-		server: server,
+		lencak:      lencak,
+		asset:       asset,
+		server:      server,
+		configFiles: ConfigFiles(config),
 	}
 
+	// the hosts of the tasks are matched before the routes of lencak
+	router.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+		_, _, ok := proxyHost(r.Host)
+		return ok
+	}).Handler(app.proxyHandler())
+	router.PathPrefix("/proxy/{workspace}/{task}/").Handler(app.proxyHandler())
+	router.Path("/proxy/{workspace}/{task}").HandlerFunc(proxyRedirect)
 	router.Path("/").Methods("GET").HandlerFunc(app.indexHandler())
 	router.Path("/js/{file:.*}").Methods("GET").HandlerFunc(app.Static("assets/js/{{file}}"))
 	router.Path("/ws").HandlerFunc(app.lencakWebsocket())
+	router.Path("/api/command").Methods("POST").HandlerFunc(app.commandHandler())
 
 	return app
 }
@@ -90,7 +107,7 @@ func upgradeCheckOrigin(r *http.Request) bool {
 
 func (app *App) lencakWebsocket() http.HandlerFunc {
 	// uprader
-	var upgrader = websocket.Upgrader{CheckOrigin: upgradeCheckOrigin,}
+	var upgrader = websocket.Upgrader{CheckOrigin: upgradeCheckOrigin}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		ws, err := upgrader.Upgrade(w, r, nil)
@@ -107,7 +124,7 @@ func (app *App) lencakWebsocket() http.HandlerFunc {
 
 		go func() {
 			// write our workspace when they connected
-			msg, err := json.Marshal(app.lencak.workspaces)
+			msg, err := json.Marshal(app.lencak)
 			if err != nil {
 				log.Errorf("websocket error marshalling workspace %s", err.Error())
 				return
@@ -120,7 +137,7 @@ func (app *App) lencakWebsocket() http.HandlerFunc {
 			for {
 				select {
 				case <-app.lencak.sync:
-					msg, err := json.Marshal(app.lencak.workspaces)
+					msg, err := json.Marshal(app.lencak)
 					if err != nil {
 						log.Errorf("websocket error marshalling workspace %s", err.Error())
 						return
@@ -139,11 +156,23 @@ func (app *App) lencakWebsocket() http.HandlerFunc {
 			}
 		}()
 
+		// the commands of the connection are handled in the order they are
+		// received, a long command is handled apart so that it doesn't hold
+		// the others, e.g start_group, see WSMessage.long
+		queue := make(chan WSMessage, 64)
+		defer close(queue)
+		go func() {
+			for msg := range queue {
+				app.handleWSCommand(msg)
+			}
+		}()
+
 		// reader
-		ws.SetReadLimit(512)
+		ws.SetReadLimit(wsMaxMessageSize)
 		ws.SetReadDeadline(time.Now().Add(wsPongWait))
 		ws.SetPongHandler(func(string) error {
-			ws.SetReadDeadline(time.Now().Add(wsPongWait)); return nil
+			ws.SetReadDeadline(time.Now().Add(wsPongWait))
+			return nil
 		})
 		for {
 			mtype, message, err := ws.ReadMessage()
@@ -158,21 +187,77 @@ func (app *App) lencakWebsocket() http.HandlerFunc {
 				}
 				log.Infof("websocket receive message w: %s, t: %s, c: %s",
 					wsMsg.Workspace, wsMsg.Task, wsMsg.Command)
-				if wsMsg.Workspace != "" && wsMsg.Task != "" {
-					switch wsMsg.Command {
-					case "start":
-						app.lencak.StartTask(wsMsg.Workspace, wsMsg.Task, wsMsg.Service)
-					case "stop":
-						app.lencak.StopTask(wsMsg.Workspace, wsMsg.Task, wsMsg.Service)
-					default:
-						log.Infof("receive message from websocket %s", string(message))
-					}
+				if wsMsg.long() {
+					go app.handleWSCommand(wsMsg)
+				} else {
+					queue <- wsMsg
 				}
 			}
 		}
 	}
 }
 
+// handleWSCommand executes a command received from the websocket, the client is
+// notified of its result by the next sync of the workspaces
+func (app *App) handleWSCommand(msg WSMessage) {
+	if _, err := app.handleCommand(msg); err != nil {
+		log.Errorf("websocket command %s failed: %v", msg.Command, err)
+	}
+}
+
+// SetConfigLoader sets the function used to load the configuration when it's reloaded
+func (app *App) SetConfigLoader(loader ConfigLoader) {
+	app.loader = loader
+}
+
+// ReloadConfig loads the configuration again and applies it to the running workspaces
+func (app *App) ReloadConfig() (*ReloadReport, error) {
+	if app.loader == nil {
+		return nil, errors.New("configuration reload is not supported")
+	}
+	config, err := app.loader()
+	if err != nil {
+		log.Errorf("configuration reload failed: %v", err)
+		return nil, err
+	}
+	app.filesMu.Lock()
+	app.configFiles = ConfigFiles(config)
+	app.filesMu.Unlock()
+	return app.lencak.Reload(config), nil
+}
+
+// WatchConfig polls paths and the files the configuration was loaded from every
+// interval and reloads the configuration when one of them changed. Watching a
+// directory detects files added to or removed from it.
+func (app *App) WatchConfig(paths []string, interval time.Duration) {
+	modTimes := func() map[string]time.Time {
+		app.filesMu.Lock()
+		files := append(append([]string{}, paths...), app.configFiles...)
+		app.filesMu.Unlock()
+
+		times := make(map[string]time.Time)
+		for _, f := range files {
+			if fi, err := os.Stat(f); err == nil {
+				times[f] = fi.ModTime()
+			}
+		}
+		return times
+	}
+
+	go func() {
+		last := modTimes()
+		for range time.Tick(interval) {
+			if reflect.DeepEqual(last, modTimes()) {
+				continue
+			}
+			log.Info("Workspace files changed, reloading configuration")
+			app.ReloadConfig()
+			// the reload may have changed the set of files
+			last = modTimes()
+		}
+	}()
+}
+
 func (app *App) Static(pattern string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		vars := mux.Vars(req)
@@ -198,6 +283,10 @@ func (app *App) ListenAndServe(addr string) error {
 		syscall.SIGTERM,
 		syscall.SIGINT)
 
+	// SIGHUP reloads the configuration
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
 	serveErr := make(chan error)
 
 	l, err := net.Listen("tcp", addr)
@@ -211,26 +300,24 @@ func (app *App) ListenAndServe(addr string) error {
 
 	defer func() {
 		log.Info("Clean up tasks processes")
-		for _, ws := range app.lencak.workspaces {
-			for _, t := range ws.Tasks {
-				t.activeMu.Lock()
-				if t.ActiveTask != nil && t.ActiveTask.Cmd != nil && t.ActiveTask.Cmd.Process != nil {
-					t.ActiveTask.Stop(t.KillSignal)
-				}
-				t.activeMu.Unlock()
-			}
-		}
+		app.lencak.Shutdown()
 	}()
 
-	select {
-	case err = <-serveErr:
-		return err
+	for {
+		select {
+		case err = <-serveErr:
+			return err
 
-	case <-quit:
-		log.Info("shutdown server")
-		c, cancel := context.WithTimeout(context.Background(), time.Second*30)
-		defer cancel()
-		return app.server.Shutdown(c)
+		case <-hup:
+			log.Info("received SIGHUP, reloading configuration")
+			app.ReloadConfig()
+
+		case <-quit:
+			log.Info("shutdown server")
+			c, cancel := context.WithTimeout(context.Background(), time.Second*30)
+			defer cancel()
+			return app.server.Shutdown(c)
+		}
 	}
 }
 
@@ -245,7 +332,7 @@ func (app *App) indexHandler() func(http.ResponseWriter, *http.Request) {
 	tmpl, err = tmpl.Parse(string(asset))
 
 	return func(w http.ResponseWriter, req *http.Request) {
-		workspaces, err := json.Marshal(app.lencak.workspaces)
+		workspaces, err := json.Marshal(app.lencak)
 		if err != nil {
 			log.Printf("error marshaling workspace: %s", err)
 			w.WriteHeader(500)
@@ -0,0 +1,51 @@
+package app
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketLargeMessage(t *testing.T) {
+	cfg, err := Parse(strings.NewReader("name: w\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	asset := func(string) ([]byte, error) { return []byte{}, nil }
+	app := NewApp(map[string]*ConfigWorkspace{"w": cfg}, asset)
+	defer app.lencak.Shutdown()
+	server := httptest.NewServer(app.server.Handler)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	reason := strings.Repeat("x", 16<<10)
+	if err := conn.WriteJSON(&WSMessage{Command: "lock", Workspace: "w", Owner: "me", Reason: reason}); err != nil {
+		t.Fatal(err)
+	}
+
+	ws, err := app.lencak.workspace("w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if lock := ws.CurrentLock(); lock != nil {
+			if lock.Reason != reason {
+				t.Errorf("lock reason of %d bytes, want %d", len(lock.Reason), len(reason))
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("workspace not locked by the websocket message")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
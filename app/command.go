@@ -0,0 +1,286 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type WSMessage struct {
+	Workspace string `json:"workspace"`
+	Task      string `json:"task"`
+	Service   bool   `json:"service"`
+	// start, stop, signal, call, lock, unlock, reload, start_group, stop_group,
+	// start_workspace, stop_workspace, restart_workspace, switch_profile, tasks,
+	// runs, rerun or scale
+	Command string `json:"command"`
+
+	// a label selector, e.g "tier=backend", selecting the tasks of tasks, start and
+	// stop instead of a single task
+	Selector string `json:"selector,omitempty"`
+
+	// the group of tasks of start_group and stop_group
+	Group string `json:"group,omitempty"`
+	// the pipeline of start_pipeline, stop_pipeline and retry_pipeline
+	Pipeline string `json:"pipeline,omitempty"`
+	// the id of the run of the task to re-run, or of the pipeline to retry
+	Run int `json:"run,omitempty"`
+	// the chain of triggered runs listed by runs instead of the runs of a task
+	Correlation string `json:"correlation,omitempty"`
+	// the profile switched to, an empty profile deactivates the active one
+	Profile string `json:"profile,omitempty"`
+	// the number of instances a task is scaled to
+	Replicas int `json:"replicas,omitempty"`
+
+	// the function to call, or whose runs are listed, and its arguments, or the
+	// parameters of a started task
+	Function  string            `json:"function,omitempty"`
+	Arguments map[string]string `json:"arguments,omitempty"`
+	// the arguments appended to the command of a started task
+	ExtraArgs []string `json:"extra_args,omitempty"`
+	// wait for the run of a call or a started task to exit before responding
+	Wait bool `json:"wait,omitempty"`
+
+	// the signal to send, e.g sighup
+	Signal string `json:"signal,omitempty"`
+
+	// the owner and reason of a lock, a lock without ttl, e.g "30m", never expires.
+	// force releases a lock owned by someone else.
+	Owner  string `json:"owner,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	TTL    string `json:"ttl,omitempty"`
+	Force  bool   `json:"force,omitempty"`
+}
+
+// long returns true for the commands acting on many tasks or waiting for runs,
+// they may take long to complete
+func (msg *WSMessage) long() bool {
+	switch msg.Command {
+	case "reload", "reload_task", "start_group", "stop_group", "start_workspace", "stop_workspace",
+		"restart_workspace", "switch_profile", "start_pipeline", "stop_pipeline", "retry_pipeline":
+		return true
+	case "start", "stop":
+		return msg.Wait || msg.Selector != "" && msg.Task == ""
+	}
+	return msg.Wait
+}
+
+// handleCommand executes a command received from the websocket or the api
+func (app *App) handleCommand(msg WSMessage) (interface{}, error) {
+	switch msg.Command {
+	case "reload":
+		if msg.Workspace != "" || msg.Task != "" {
+			return nil, fmt.Errorf("command reload reloads the configuration, reload a task with reload_task")
+		}
+		return app.ReloadConfig()
+	case "reload_task":
+		if msg.Workspace == "" || msg.Task == "" {
+			return nil, fmt.Errorf("command reload_task requires a workspace and a task")
+		}
+		return nil, app.lencak.ReloadTask(msg.Workspace, msg.Task)
+	case "call":
+		if msg.Workspace == "" || msg.Function == "" {
+			return nil, fmt.Errorf("command call requires a workspace and a function")
+		}
+		tr, err := app.lencak.CallFunction(msg.Workspace, msg.Function, msg.Arguments)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Wait {
+			tr.Wait()
+		}
+		return tr, nil
+	case "tasks":
+		// without a selector every task is listed
+		var sel Selector
+		if msg.Selector != "" {
+			var err error
+			if sel, err = ParseSelector(msg.Selector); err != nil {
+				return nil, err
+			}
+		}
+		return app.lencak.FindTasks(msg.Workspace, sel)
+	case "start", "stop", "signal":
+		if msg.Selector != "" && msg.Command != "signal" && msg.Task == "" {
+			if msg.Workspace == "" {
+				return nil, fmt.Errorf("command %s requires a workspace", msg.Command)
+			}
+			sel, err := ParseSelector(msg.Selector)
+			if err != nil {
+				return nil, err
+			}
+			if msg.Command == "start" {
+				return app.lencak.StartSelected(msg.Workspace, sel)
+			}
+			return app.lencak.StopSelected(msg.Workspace, sel)
+		}
+		if msg.Workspace == "" || msg.Task == "" {
+			return nil, fmt.Errorf("command %s requires a workspace and a task", msg.Command)
+		}
+		switch msg.Command {
+		case "start":
+			opts := &RunOptions{Parameters: msg.Arguments, Args: msg.ExtraArgs}
+			tr, err := app.lencak.StartTask(msg.Workspace, msg.Task, msg.Service, opts)
+			if err != nil {
+				return nil, err
+			}
+			if msg.Wait {
+				tr = tr.WaitAttempts()
+			}
+			return tr, nil
+		case "stop":
+			return nil, app.lencak.StopTask(msg.Workspace, msg.Task, msg.Service)
+		default:
+			return nil, app.lencak.SignalTask(msg.Workspace, msg.Task, msg.Signal)
+		}
+	case "start_group", "stop_group":
+		if msg.Workspace == "" || msg.Group == "" {
+			return nil, fmt.Errorf("command %s requires a workspace and a group", msg.Command)
+		}
+		if msg.Command == "start_group" {
+			return app.lencak.StartGroup(msg.Workspace, msg.Group)
+		}
+		return app.lencak.StopGroup(msg.Workspace, msg.Group)
+	case "pipelines":
+		if msg.Workspace == "" {
+			return nil, fmt.Errorf("command pipelines requires a workspace")
+		}
+		return app.lencak.Pipelines(msg.Workspace)
+	case "start_pipeline", "stop_pipeline", "retry_pipeline":
+		if msg.Workspace == "" || msg.Pipeline == "" {
+			return nil, fmt.Errorf("command %s requires a workspace and a pipeline", msg.Command)
+		}
+		switch msg.Command {
+		case "start_pipeline":
+			return app.lencak.StartPipeline(msg.Workspace, msg.Pipeline)
+		case "stop_pipeline":
+			return app.lencak.StopPipeline(msg.Workspace, msg.Pipeline)
+		default:
+			return app.lencak.RetryPipeline(msg.Workspace, msg.Pipeline, msg.Run)
+		}
+	case "start_workspace", "stop_workspace", "restart_workspace":
+		if msg.Workspace == "" {
+			return nil, fmt.Errorf("command %s requires a workspace", msg.Command)
+		}
+		switch msg.Command {
+		case "start_workspace":
+			return app.lencak.StartWorkspace(msg.Workspace)
+		case "stop_workspace":
+			return app.lencak.StopWorkspace(msg.Workspace)
+		default:
+			return app.lencak.RestartWorkspace(msg.Workspace)
+		}
+	case "switch_profile":
+		if msg.Workspace == "" {
+			return nil, fmt.Errorf("command switch_profile requires a workspace")
+		}
+		return app.lencak.SwitchProfile(msg.Workspace, msg.Profile)
+	case "runs", "rerun":
+		if msg.Command == "runs" && msg.Correlation != "" {
+			if msg.Workspace == "" {
+				return nil, fmt.Errorf("command runs requires a workspace with a correlation")
+			}
+			return app.lencak.CorrelatedRuns(msg.Workspace, msg.Correlation)
+		}
+		if msg.Command == "runs" && msg.Function != "" {
+			if msg.Workspace == "" {
+				return nil, fmt.Errorf("command runs requires a workspace with a function")
+			}
+			return app.lencak.FunctionRuns(msg.Workspace, msg.Function)
+		}
+		if msg.Workspace == "" || msg.Task == "" {
+			return nil, fmt.Errorf("command %s requires a workspace and a task", msg.Command)
+		}
+		if msg.Command == "runs" {
+			return app.lencak.TaskRuns(msg.Workspace, msg.Task)
+		}
+		tr, err := app.lencak.RerunTask(msg.Workspace, msg.Task, msg.Run)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Wait {
+			tr = tr.WaitAttempts()
+		}
+		return tr, nil
+	case "scale":
+		if msg.Workspace == "" || msg.Task == "" {
+			return nil, fmt.Errorf("command scale requires a workspace and a task")
+		}
+		return nil, app.lencak.ScaleTask(msg.Workspace, msg.Task, msg.Replicas)
+	case "lock":
+		var ttl time.Duration
+		if msg.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(msg.TTL); err != nil {
+				return nil, fmt.Errorf("invalid lock ttl: %v", err)
+			}
+		}
+		return app.lencak.LockWorkspace(msg.Workspace, msg.Owner, msg.Reason, ttl)
+	case "unlock":
+		return nil, app.lencak.UnlockWorkspace(msg.Workspace, msg.Owner, msg.Force)
+	default:
+		return nil, fmt.Errorf("unknown command %q", msg.Command)
+	}
+}
+
+// commandHandler accepts the same messages as the websocket over plain http and
+// responds with the result of the command. Requests from another origin are
+// refused, and requiring a json body makes browsers send a preflight request
+// that is never allowed, so no web page can send commands.
+func (app *App) commandHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !upgradeCheckOrigin(r) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "origin not allowed"})
+			return
+		}
+		if t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || t != "application/json" {
+			writeJSON(w, http.StatusUnsupportedMediaType, map[string]string{"error": "content type must be application/json"})
+			return
+		}
+
+		var msg WSMessage
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&msg); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		log.Infof("api receive message w: %s, t: %s, c: %s", msg.Workspace, msg.Task, msg.Command)
+
+		result, err := app.handleCommand(msg)
+		if err != nil {
+			writeJSON(w, errorStatus(err), map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": result})
+	}
+}
+
+// errorStatus returns the http status code of a command error
+func errorStatus(err error) int {
+	switch err.(type) {
+	case *NotFoundError:
+		return http.StatusNotFound
+	case *LockedError:
+		return http.StatusLocked
+	case *BusyError:
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("error marshalling response: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
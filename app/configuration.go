@@ -5,9 +5,12 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
-	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
@@ -19,6 +22,40 @@ type ConfigWorkspace struct {
 	Tasks              []*ConfigTask                  `yaml:"tasks"`
 	Columns            map[string]map[string][]string `yaml:"columns,omitempty"`
 	InheritEnvironment bool                           `yaml:"inherit_environment,omitempty"`
+	Include            []string                       `yaml:"include,omitempty"`
+	Defaults           *ConfigTask                    `yaml:"defaults,omitempty"`
+	Templates          map[string]*ConfigTask         `yaml:"templates,omitempty"`
+	Profiles           map[string]*ConfigProfile      `yaml:"profiles,omitempty"`
+	Pipelines          map[string]*ConfigPipeline     `yaml:"pipelines,omitempty"`
+
+	// the file the workspace was loaded from
+	file string
+	// the files merged into the workspace, including file
+	files []string
+	// the profile selected at startup, see SelectProfiles
+	profile string
+	// the warnings found while parsing the files, reported by Validate
+	warnings ValidationErrors
+}
+
+// ConfigProfile is the config for a profile: the tasks started when the profile
+// is active and the environment overlaid on the environment of every task
+type ConfigProfile struct {
+	Tasks       []string          `yaml:"tasks"`
+	Environment map[string]string `yaml:"environment,omitempty"`
+}
+
+// ConfigPipeline is the config for a pipeline: its stages run one after the
+// other and the tasks of a stage run in parallel
+type ConfigPipeline struct {
+	Stages []*ConfigStage `yaml:"stages"`
+}
+
+// ConfigStage is the config for a stage of a pipeline, the stage is named after
+// its position when it has no name
+type ConfigStage struct {
+	Name  string   `yaml:"name,omitempty"`
+	Tasks []string `yaml:"tasks"`
 }
 
 // ConfigFunction is the config for a function
@@ -39,8 +76,132 @@ type ConfigTask struct {
 	Executor    []string          `yaml:"executor,omitempty"`
 	Stdout      string            `yaml:"stdout,omitempty"`
 	Stderr      string            `yaml:"stderr,omitempty"`
-	Metadata    map[string]string `yaml:"metada,omitempty"`
 	Pwd         string            `yaml:"pwd,omitempty"`
+	Extends     string            `yaml:"extends,omitempty"`
+	// the tasks that must be ready before the task starts
+	DependsOn []string `yaml:"depends_on,omitempty"`
+	// labels select tasks, e.g tier: backend, metadata describes them, e.g a url
+	Labels   map[string]string `yaml:"labels,omitempty"`
+	Metadata map[string]string `yaml:"metadata,omitempty"`
+	// Metada is the deprecated spelling of metadata, still accepted
+	Metada map[string]string `yaml:"metada,omitempty"`
+	// the environment variables that can be overridden when the task is started,
+	// and whether extra arguments can be appended to its command
+	Parameters []*ConfigParameter `yaml:"parameters,omitempty"`
+	ExtraArgs  bool               `yaml:"extra_args,omitempty"`
+	// the number of instances of the task, each run with its own $INSTANCE, and
+	// the offset of $PORT between two instances, 0 keeps the same port
+	Replicas   int `yaml:"replicas,omitempty"`
+	PortOffset int `yaml:"port_offset,omitempty"`
+	// the ports of the task by variable, a free port is allocated to a variable
+	// mapped to 0, e.g PORT: 0
+	Ports map[string]int `yaml:"ports,omitempty"`
+	// an on-demand task is started by the first request proxied to it and
+	// stopped after idle_timeout without traffic, e.g "10m"
+	OnDemand    bool   `yaml:"on_demand,omitempty"`
+	IdleTimeout string `yaml:"idle_timeout,omitempty"`
+	// the sockets lencak listens on and passes to the task by name, a tcp address
+	// or unix:<path>, e.g http: ":$PORT"
+	Sockets map[string]string `yaml:"sockets,omitempty"`
+	// the files restarting the task when they change
+	Watch *ConfigWatch `yaml:"watch,omitempty"`
+	// commands run with the environment and the pwd of the task around its
+	// process, a failing before_start prevents the task from starting
+	BeforeStart string `yaml:"before_start,omitempty"`
+	AfterStart  string `yaml:"after_start,omitempty"`
+	BeforeStop  string `yaml:"before_stop,omitempty"`
+	AfterStop   string `yaml:"after_stop,omitempty"`
+	// the command stopping the task instead of its kill signal, the signal is
+	// still sent when the task doesn't exit in time
+	StopCommand string `yaml:"stop_command,omitempty"`
+	// the time given to a hook, the stop command or the reload command before
+	// it's killed, e.g "5m"
+	HookTimeout string `yaml:"hook_timeout,omitempty"`
+	// the signal, e.g sighup, or the command reloading the running task, it's
+	// restarted when it has neither
+	ReloadSignal  string `yaml:"reload_signal,omitempty"`
+	ReloadCommand string `yaml:"reload_command,omitempty"`
+	// the tasks started when a run of the task exits with a zero status, a non
+	// zero status or either
+	OnSuccess []string `yaml:"on_success,omitempty"`
+	OnFailure []string `yaml:"on_failure,omitempty"`
+	OnExit    []string `yaml:"on_exit,omitempty"`
+	// the number of times a failed run is retried, only the exit statuses of
+	// retry_on are retried when it's set. The delay before a retry starts at
+	// retry_backoff and doubles with every attempt.
+	Retries      int    `yaml:"retries,omitempty"`
+	RetryOn      []int  `yaml:"retry_on,omitempty"`
+	RetryBackoff string `yaml:"retry_backoff,omitempty"`
+
+	// the file and line declaring the task, line is 0 when unknown
+	file string
+	line int
+	// the keys set in the file, an explicit zero value overrides the defaults
+	// and templates, see mergeConfig
+	set map[string]bool
+}
+
+// ConfigWatch is the config for the files watched by a task, a running service
+// is restarted when they change and any other task is run again
+type ConfigWatch struct {
+	// files or directories, watched recursively, relative to the pwd of the task
+	Paths []string `yaml:"paths"`
+	// globs matching the name of a file, its path relative to a watched path or
+	// one of its directories, e.g "*.go" or "vendor"
+	Include []string `yaml:"include,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty"`
+	// the time to wait for more changes before restarting the task, e.g "1s"
+	Debounce string `yaml:"debounce,omitempty"`
+}
+
+// hooks returns the hook commands of the task by name
+func (t *ConfigTask) hooks() map[string]string {
+	hooks := make(map[string]string)
+	for name, command := range map[string]string{
+		"before_start": t.BeforeStart,
+		"after_start":  t.AfterStart,
+		"before_stop":  t.BeforeStop,
+		"after_stop":   t.AfterStop,
+	} {
+		if command != "" {
+			hooks[name] = command
+		}
+	}
+	return hooks
+}
+
+// hookTimeout returns the time given to a command run around the process of the
+// task before it's killed
+func (t *ConfigTask) hookTimeout() time.Duration {
+	if d, err := time.ParseDuration(t.HookTimeout); err == nil && d > 0 {
+		return d
+	}
+	return defaultHookTimeout
+}
+
+// retryBackoff returns the delay before the first retry of a failed run
+func (t *ConfigTask) retryBackoff() time.Duration {
+	if d, err := time.ParseDuration(t.RetryBackoff); err == nil && d > 0 {
+		return d
+	}
+	return defaultRetryBackoff
+}
+
+// replicas returns the number of instances of the task, at least 1
+func (t *ConfigTask) replicas() int {
+	if t.Replicas < 1 {
+		return 1
+	}
+	return t.Replicas
+}
+
+// ConfigParameter is the config for a parameter of a task, an environment
+// variable given when the task is started
+type ConfigParameter struct {
+	Name        string `yaml:"name" json:"name"`
+	Default     string `yaml:"default,omitempty" json:"default,omitempty"`
+	Required    bool   `yaml:"required,omitempty" json:"required,omitempty"`
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
 }
 
 type KillSignal string
@@ -69,7 +230,8 @@ func (killsignal *KillSignal) UnmarshalYAML(unmarshal func(interface{}) error) e
 	return nil
 }
 
-// parse config
+// Parse parses a workspace configuration, fields that don't exist in the
+// configuration and duplicated keys are rejected
 func Parse(rd io.Reader) (*ConfigWorkspace, error) {
 	in, err := ioutil.ReadAll(rd)
 	if err != nil {
@@ -77,14 +239,178 @@ func Parse(rd io.Reader) (*ConfigWorkspace, error) {
 	}
 
 	var cfg *ConfigWorkspace
-	err = yaml.Unmarshal(in, &cfg)
+	err = yaml.UnmarshalStrict(in, &cfg)
 	if err != nil {
 		return nil, err
 	}
+	if cfg != nil {
+		cfg.locateTasks(in)
+		if err = cfg.recordKeys(in); err != nil {
+			return nil, err
+		}
+		cfg.foldDeprecated()
+	}
 
 	return cfg, err
 }
 
+var (
+	// tasksKeyRe matches the top level tasks key of a workspace
+	tasksKeyRe = regexp.MustCompile(`^tasks:\s*(#.*)?$`)
+	// itemRe matches the first line of an item of a sequence
+	itemRe = regexp.MustCompile(`^(\s*)-(\s+|$)(.*)$`)
+	// nameKeyRe matches a name key and its value
+	nameKeyRe = regexp.MustCompile(`^name:\s*["']?([^"'#]*?)["']?\s*(#.*)?$`)
+)
+
+// locateTasks records the line of each task in src. Only the name key of the
+// items of the top level tasks sequence are considered, the names of nested
+// mappings, e.g parameters, are ignored. Tasks are expected in the same order as
+// they are declared in the file.
+func (cfg *ConfigWorkspace) locateTasks(src []byte) {
+	lines := strings.Split(string(src), "\n")
+	start := -1
+	for i, line := range lines {
+		if tasksKeyRe.MatchString(line) {
+			start = i + 1
+			break
+		}
+	}
+	if start < 0 {
+		return
+	}
+
+	// the line of the name of each item, by order of declaration
+	names := make(map[int]string)
+	var order []int
+	dash, key := -1, -1
+	for i := start; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if m := itemRe.FindStringSubmatch(line); m != nil && (dash < 0 || indent == dash) {
+			dash = indent
+			key = indent + 1 + len(m[2])
+			if m[3] == "" {
+				// the keys of the item start on the next line
+				key = -1
+			}
+			if m := nameKeyRe.FindStringSubmatch(m[3]); m != nil {
+				names[i] = m[1]
+				order = append(order, i)
+			}
+			continue
+		}
+		if indent <= dash || (dash < 0 && indent == 0) {
+			// the end of the tasks sequence
+			break
+		}
+		if key < 0 {
+			key = indent
+		}
+		if indent == key {
+			if m := nameKeyRe.FindStringSubmatch(trimmed); m != nil {
+				names[i] = m[1]
+				order = append(order, i)
+			}
+		}
+	}
+
+	next := 0
+	for _, t := range cfg.Tasks {
+		if t == nil {
+			continue
+		}
+		for j := next; j < len(order); j++ {
+			if names[order[j]] == t.Name {
+				t.line = order[j] + 1
+				next = j + 1
+				break
+			}
+		}
+	}
+}
+
+// foldDeprecated merges the deprecated keys of the defaults, the templates and
+// the tasks into the keys replacing them and records a warning for each
+func (cfg *ConfigWorkspace) foldDeprecated() {
+	fold := func(t *ConfigTask, task, prefix string) {
+		if t == nil || t.Metada == nil {
+			return
+		}
+		if t.Metadata == nil {
+			t.Metadata = make(map[string]string, len(t.Metada))
+		}
+		for k, v := range t.Metada {
+			if _, ok := t.Metadata[k]; !ok {
+				t.Metadata[k] = v
+			}
+		}
+		t.Metada = nil
+		cfg.warnings = append(cfg.warnings, &ConfigError{
+			Line:    t.line,
+			Task:    task,
+			Message: prefix + "metada is deprecated, use metadata",
+			Warning: true,
+		})
+	}
+
+	fold(cfg.Defaults, "", "defaults: ")
+	names := make([]string, 0, len(cfg.Templates))
+	for name := range cfg.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fold(cfg.Templates[name], "", fmt.Sprintf("template %q: ", name))
+	}
+	for _, t := range cfg.Tasks {
+		if t != nil {
+			fold(t, t.Name, "")
+		}
+	}
+}
+
+// recordKeys records the keys set for the defaults, the templates and the tasks
+// in src, see mergeConfig
+func (cfg *ConfigWorkspace) recordKeys(src []byte) error {
+	var raw struct {
+		Defaults  map[string]interface{}            `yaml:"defaults"`
+		Templates map[string]map[string]interface{} `yaml:"templates"`
+		Tasks     []map[string]interface{}          `yaml:"tasks"`
+	}
+	if err := yaml.Unmarshal(src, &raw); err != nil {
+		return err
+	}
+	keys := func(m map[string]interface{}) map[string]bool {
+		set := make(map[string]bool, len(m))
+		for k := range m {
+			set[k] = true
+		}
+		return set
+	}
+	if cfg.Defaults != nil {
+		cfg.Defaults.set = keys(raw.Defaults)
+	}
+	for name, tmpl := range cfg.Templates {
+		if tmpl != nil {
+			tmpl.set = keys(raw.Templates[name])
+		}
+	}
+	for i, t := range cfg.Tasks {
+		if t != nil && i < len(raw.Tasks) {
+			t.set = keys(raw.Tasks[i])
+		}
+	}
+	return nil
+}
+
+// ParseFile parses the workspace file at path. Relative include patterns and
+// relative pwd, stdout and stderr of tasks are resolved against the directory
+// of the file.
 func ParseFile(path string) (*ConfigWorkspace, error) {
 	fp, err := os.Open(path)
 	if err != nil {
@@ -95,25 +421,49 @@ func ParseFile(path string) (*ConfigWorkspace, error) {
 
 	config, err := Parse(fp)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+		return nil, parseErrors(path, err)
+	}
+	if config != nil {
+		config.file = path
+		config.files = []string{path}
+		for _, warning := range config.warnings {
+			warning.(*ConfigError).File = path
+		}
+		dir, err := filepath.Abs(filepath.Dir(path))
+		if err != nil {
+			return nil, err
+		}
+		config.resolvePaths(dir)
 	}
 
 	return config, nil
 }
 
-func LoadConfig(workspaces []string) (map[string]*ConfigWorkspace, error) {
-	var configWorkspaces = make(map[string]*ConfigWorkspace)
-	// Load workspaces
-	for _, conf := range workspaces {
-		log.Infof("Loading workspace file: %s", conf)
-		cfg, err := ParseFile(conf)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing %s: %v", conf, err)
-		}
-		if cfg != nil {
-			configWorkspaces[cfg.Name] = cfg
+// resolvePaths resolves the relative paths of the workspace against dir
+func (cfg *ConfigWorkspace) resolvePaths(dir string) {
+	for i, pattern := range cfg.Include {
+		cfg.Include[i] = resolvePath(dir, pattern)
+	}
+	tasks := append([]*ConfigTask{cfg.Defaults}, cfg.Tasks...)
+	for _, tmpl := range cfg.Templates {
+		tasks = append(tasks, tmpl)
+	}
+	for _, t := range tasks {
+		if t == nil {
+			continue
 		}
+		t.file = cfg.file
+		t.Pwd = resolvePath(dir, t.Pwd)
+		t.Stdout = resolvePath(dir, t.Stdout)
+		t.Stderr = resolvePath(dir, t.Stderr)
 	}
+}
 
-	return configWorkspaces, nil
+// resolvePath joins a relative path to dir. Empty paths and paths starting
+// with a variable are returned unchanged.
+func resolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) || strings.HasPrefix(path, "$") {
+		return path
+	}
+	return filepath.Join(dir, path)
 }
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLocateTasks(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want map[string]int
+	}{
+		{
+			name: "names of nested mappings are ignored",
+			src: `name: w
+pipelines:
+  p:
+    stages:
+      - name: b
+        tasks: [a]
+tasks:
+  - name: a
+    command: echo
+    parameters:
+      - name: b
+  - command: echo
+    name: b
+`,
+			want: map[string]int{"a": 8, "b": 13},
+		},
+		{
+			name: "items at the indentation of the key",
+			src: `tasks:
+- name: a
+  command: echo
+-
+  name: b
+  command: echo
+name: w
+`,
+			want: map[string]int{"a": 2, "b": 5},
+		},
+		{
+			name: "quoted names and comments",
+			src: `tasks:
+  # - name: b
+  - name: "a" # first
+    command: echo
+  - name: 'b'
+    command: echo
+`,
+			want: map[string]int{"a": 3, "b": 5},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := Parse(strings.NewReader(test.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]int)
+			for _, task := range cfg.Tasks {
+				got[task.Name] = task.line
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got lines %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDeprecatedMetada(t *testing.T) {
+	task := parseTask(t, "{name: a, metada: {url: x, doc: y}, metadata: {url: z}}")
+	want := map[string]string{"url": "z", "doc": "y"}
+	if !reflect.DeepEqual(task.Metadata, want) {
+		t.Errorf("got metadata %v, want %v", task.Metadata, want)
+	}
+	if task.Metada != nil {
+		t.Errorf("got metada %v, want it folded into metadata", task.Metada)
+	}
+
+	cfg, err := Parse(strings.NewReader("name: w\ntasks:\n  - name: a\n    command: echo\n    metada: {url: x}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var warnings []string
+	for _, err := range cfg.Validate() {
+		warnings = append(warnings, err.Error())
+	}
+	wantWarnings := []string{`warning: :3: task "a": metada is deprecated, use metadata`}
+	if !reflect.DeepEqual(warnings, wantWarnings) {
+		t.Errorf("got warnings %q, want %q", warnings, wantWarnings)
+	}
+}
@@ -0,0 +1,98 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Function is a parameterised command of a workspace
+type Function struct {
+	Name     string
+	Args     []string
+	Command  string
+	Executor []string
+
+	mu   sync.Mutex
+	Runs []*TaskRun
+	// the id of the next run, the oldest runs are dropped past maxFunctionRuns
+	nextRun int
+}
+
+// maxFunctionRuns is the number of runs kept by a function
+const maxFunctionRuns = 100
+
+// MarshalJSON summarizes the last runs of the function like the json of a task,
+// the output of the runs is listed by the runs command, see Lencak.FunctionRuns
+func (fn *Function) MarshalJSON() ([]byte, error) {
+	fn.mu.Lock()
+	runs := fn.Runs
+	if len(runs) > maxRunSummaries {
+		runs = runs[len(runs)-maxRunSummaries:]
+	}
+	summaries := make([]*runSummary, len(runs))
+	for i, tr := range runs {
+		summaries[i] = tr.summary()
+	}
+	fn.mu.Unlock()
+
+	return json.Marshal(&struct {
+		Name     string        `json:"name"`
+		Args     []string      `json:"args,omitempty"`
+		Command  string        `json:"command"`
+		Executor []string      `json:"executor,omitempty"`
+		Runs     []*runSummary `json:"runs"`
+	}{
+		Name:     fn.Name,
+		Args:     fn.Args,
+		Command:  fn.Command,
+		Executor: fn.Executor,
+		Runs:     summaries,
+	})
+}
+
+// runs returns the runs kept by the function
+func (fn *Function) runs() []*TaskRun {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	return append([]*TaskRun{}, fn.Runs...)
+}
+
+// Call starts a run of the function. Every argument declared by the function must
+// be given and no other, the arguments are passed in the environment of the run,
+// see newTaskRun. The exit status of the run is sent on exitCh.
+func (fn *Function) Call(args map[string]string, environment map[string]string, exitCh chan int) (*TaskRun, error) {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+
+	for _, name := range fn.Args {
+		if _, ok := args[name]; !ok {
+			return nil, fmt.Errorf("function %s: missing argument %s", fn.Name, name)
+		}
+	}
+	for name := range args {
+		if !containsString(fn.Args, name) {
+			return nil, fmt.Errorf("function %s: unknown argument %s", fn.Name, name)
+		}
+	}
+
+	tr := newTaskRun(fn.nextRun, fn.Command, fn.Executor, environment, args, "", "", "")
+	tr.Arguments = args
+	fn.nextRun++
+	fn.Runs = append(fn.Runs, tr)
+	if len(fn.Runs) > maxFunctionRuns {
+		fn.Runs = append([]*TaskRun{}, fn.Runs[len(fn.Runs)-maxFunctionRuns:]...)
+	}
+	tr.Start(exitCh)
+
+	return tr, nil
+}
+
+// update replaces the definition of fn with the one of other, keeping its runs
+func (fn *Function) update(other *Function) {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	fn.Args = other.Args
+	fn.Command = other.Command
+	fn.Executor = other.Executor
+}
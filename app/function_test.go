@@ -0,0 +1,89 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFunctionCallArguments(t *testing.T) {
+	tests := []struct {
+		name     string
+		command  string
+		executor []string
+		value    string
+		want     string
+	}{
+		{
+			name:     "a shell expands the argument",
+			command:  `echo "$NAME"`,
+			executor: []string{"sh", "-c"},
+			value:    "x; echo injected",
+			want:     "x; echo injected\n",
+		},
+		{
+			name:     "the argument is not parsed by the shell",
+			command:  `echo $NAME`,
+			executor: []string{"sh", "-c"},
+			value:    "$(echo injected)",
+			want:     "$(echo injected)\n",
+		},
+		{
+			name:    "without executor the argument is a single word",
+			command: "printf %s| $NAME",
+			value:   "a b",
+			want:    "a b|",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := &Function{Name: "fn", Args: []string{"NAME"}, Command: tt.command, Executor: tt.executor}
+			exitCh := make(chan int, 1)
+			tr, err := fn.Call(map[string]string{"NAME": tt.value}, map[string]string{}, exitCh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status := <-exitCh; status != 0 {
+				t.Fatalf("exit status %d, stderr %q", status, tr.StderrBuf.String())
+			}
+			if got := tr.StdoutBuf.String(); got != tt.want {
+				t.Errorf("output %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFunctionRunsCapped(t *testing.T) {
+	fn := &Function{Name: "fn", Command: "true"}
+	for i := 0; i < maxFunctionRuns+5; i++ {
+		exitCh := make(chan int, 1)
+		if _, err := fn.Call(map[string]string{}, map[string]string{}, exitCh); err != nil {
+			t.Fatal(err)
+		}
+		<-exitCh
+	}
+
+	runs := fn.runs()
+	if len(runs) != maxFunctionRuns {
+		t.Fatalf("kept %d runs, want %d", len(runs), maxFunctionRuns)
+	}
+	if id := runs[len(runs)-1].Id; id != maxFunctionRuns+4 {
+		t.Errorf("last run id %d, want %d", id, maxFunctionRuns+4)
+	}
+
+	out, err := json.Marshal(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Runs []map[string]interface{} `json:"runs"`
+	}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Runs) != maxRunSummaries {
+		t.Fatalf("summarized %d runs, want %d", len(got.Runs), maxRunSummaries)
+	}
+	if _, ok := got.Runs[0]["stdoutbuf"]; ok {
+		t.Errorf("summary of a run holds its output: %v", got.Runs[0])
+	}
+}
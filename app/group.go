@@ -0,0 +1,44 @@
+package app
+
+// Group returns the names of the tasks of the group named name, a group is
+// declared in one of the columns of the workspace
+func (ws *Workspace) Group(name string) ([]string, bool) {
+	for _, groups := range ws.Columns {
+		if tasks, ok := groups[name]; ok {
+			return tasks, true
+		}
+	}
+	return nil, false
+}
+
+// StartGroup starts the tasks of the group of the workspace and the tasks they
+// depend on, see startTasks
+func (lenc *Lencak) StartGroup(workSpaceName, group string) (*OperationResult, error) {
+	ws, levels, err := lenc.groupLevels(workSpaceName, group, "start", true)
+	if err != nil {
+		return nil, err
+	}
+	return lenc.runOperation(ws, "start group "+group, nil, levels)
+}
+
+// StopGroup stops the tasks of the group of the workspace, a task stops before
+// the tasks of the group it depends on
+func (lenc *Lencak) StopGroup(workSpaceName, group string) (*OperationResult, error) {
+	ws, levels, err := lenc.groupLevels(workSpaceName, group, "stop", false)
+	if err != nil {
+		return nil, err
+	}
+	return lenc.runOperation(ws, "stop group "+group, levels, nil)
+}
+
+// groupLevels returns the dependency levels of the tasks of group, including
+// the tasks they depend on when withDeps is true, unless the workspace is locked
+func (lenc *Lencak) groupLevels(workSpaceName, group, action string, withDeps bool) (*Workspace, [][]*Task, error) {
+	return lenc.operationLevels(workSpaceName, action+" group "+group, withDeps, func(ws *Workspace) ([]string, error) {
+		names, ok := ws.Group(group)
+		if !ok {
+			return nil, notFound("group %s not found in workspace %s", group, workSpaceName)
+		}
+		return names, nil
+	})
+}
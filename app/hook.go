@@ -0,0 +1,67 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// maxHookOutput is the length of the output of a hook kept in its event
+	maxHookOutput = 2048
+
+	// defaultHookTimeout is the time given to a hook, the stop or the reload
+	// command when the task doesn't set one
+	defaultHookTimeout = time.Minute
+)
+
+// runHook runs the hook named name of the run, if it has one, see runCommand
+func (tr *TaskRun) runHook(name string) error {
+	if tr.hooks[name] == "" {
+		return nil
+	}
+	return tr.runCommand("Hook "+name, tr.hooks[name])
+}
+
+// runCommand runs command with the environment, the arguments, the working
+// directory and the executor of the run. Its output and exit status are recorded
+// as an event of the run starting with label, an error is returned when it
+// failed. The command is killed when it runs longer than the hook timeout of the
+// task.
+func (tr *TaskRun) runCommand(label, command string) error {
+	timeout := tr.hookTimeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	argv := commandArgv(command, tr.Executor, tr.Environment, tr.Arguments)
+	hook := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	// the output of the children of the command left running isn't waited for
+	hook.WaitDelay = time.Second
+	hook.Dir = tr.Pwd
+	for k, v := range tr.Environment {
+		hook.Env = append(hook.Env, k+"="+v)
+	}
+	out, err := hook.CombinedOutput()
+
+	var msg string
+	if ctx.Err() == context.DeadlineExceeded {
+		msg = fmt.Sprintf("%s killed after %s", label, timeout)
+		err = fmt.Errorf("%s timed out after %s", strings.ToLower(label), timeout)
+	} else if hook.ProcessState != nil {
+		msg = fmt.Sprintf("%s exited with status %d", label, hook.ProcessState.ExitCode())
+	} else {
+		msg = fmt.Sprintf("%s failed: %v", label, err)
+	}
+	if output := strings.TrimSpace(string(out)); output != "" {
+		if len(output) > maxHookOutput {
+			output = "..." + output[len(output)-maxHookOutput:]
+		}
+		msg += ": " + output
+	}
+	tr.addEvent("%s", msg)
+	return err
+}
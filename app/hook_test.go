@@ -0,0 +1,40 @@
+package app
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRunCommandTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		task    string
+		command string
+		wantErr string
+	}{
+		{
+			name:    "a command completing in time",
+			task:    "{name: a, command: 'true', hook_timeout: 5s}",
+			command: "true",
+		},
+		{
+			name:    "a command killed after the hook timeout",
+			task:    "{name: a, command: 'true', hook_timeout: 100ms}",
+			command: "sleep 5",
+			wantErr: "hook before_start timed out after 100ms",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := NewTask(parseTask(t, tt.task), map[string]string{})
+			tr := task.NewTaskRun(0, nil)
+			err := tr.runCommand("Hook before_start", tt.command)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,44 +1,132 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
 	log "github.com/sirupsen/logrus"
 )
 
 type Lencak struct {
-	workspaces      map[string]*Workspace
-	sync            chan bool
+	mu         sync.RWMutex
+	workspaces map[string]*Workspace
+	sync       chan bool
+	ports      *portAllocator
 }
 
 func NewLencak(config map[string]*ConfigWorkspace) *Lencak {
-	sync := make(chan bool, 256)
-	workspaces := configureWorkSpaces(sync, config)
+	syncChan := make(chan bool, 256)
+	workspaces := configureWorkSpaces(syncChan, config)
 
-	return &Lencak{
-		workspaces:      workspaces,
-		sync:            sync,
+	lenc := &Lencak{
+		workspaces: workspaces,
+		sync:       syncChan,
+		ports:      newPortAllocator(),
+	}
+	for _, ws := range workspaces {
+		lenc.assignPorts(ws, nil)
+		lenc.watchTasks(ws)
+		lenc.chainTasks(ws)
+	}
+	for _, ws := range workspaces {
+		go lenc.autoStart(ws)
 	}
+	go lenc.stopIdleTasks(5 * time.Second)
+	return lenc
+}
+
+// MarshalJSON implements json.Marshaler, lencak is marshalled as its workspaces
+func (lenc *Lencak) MarshalJSON() ([]byte, error) {
+	lenc.mu.RLock()
+	defer lenc.mu.RUnlock()
+	return json.Marshal(lenc.workspaces)
 }
 
-// Start task taskName in workspaces workSpaceName, return true if task sucessfully
-// started
-func (lenc *Lencak) StartTask(workSpaceName, taskName string, asService bool) bool {
-	return lenc.WithWorkspaceTask(workSpaceName, taskName, func(task *Task) {
+// Start task taskName in workspaces workSpaceName with opts, see Task.StartWith. The
+// run of the task is returned, an error is returned when the task doesn't exist,
+// the workspace is locked or opts are invalid
+func (lenc *Lencak) StartTask(workSpaceName, taskName string, asService bool, opts *RunOptions) (*TaskRun, error) {
+	var run *TaskRun
+	err := lenc.withUnlockedTask(workSpaceName, taskName, "start", func(task *Task) error {
+		if err := task.validateRunOptions(opts); err != nil {
+			return err
+		}
+		if !opts.empty() && task.Running() {
+			return fmt.Errorf("task %s is already running", taskName)
+		}
 		if asService {
 			task.serviceMu.Lock()
 			task.Service = true
 			task.serviceMu.Unlock()
-			if task.ActiveTask == nil {
-				task.Start(lenc.sync)
+		}
+		if len(task.DependsOn) > 0 {
+			with := &RunOptions{outputs: lenc.dependencyOutputs(workSpaceName, task)}
+			if opts != nil {
+				with.Parameters, with.Args = opts.Parameters, opts.Args
 			}
-		} else {
-			task.Start(lenc.sync)
+			opts = with
+		}
+		if _, err := task.StartWith(lenc.sync, opts); err != nil {
+			return err
 		}
+		run = task.LastRun()
+		return nil
 	})
+	return run, err
+}
+
+// RerunTask starts a new run of the task taskName with the argv, the environment
+// and the working directory of its run runID, see Task.Rerun
+func (lenc *Lencak) RerunTask(workSpaceName, taskName string, runID int) (*TaskRun, error) {
+	var run *TaskRun
+	err := lenc.withUnlockedTask(workSpaceName, taskName, "rerun", func(task *Task) error {
+		var err error
+		run, err = task.Rerun(lenc.sync, runID)
+		return err
+	})
+	return run, err
+}
+
+// TaskRuns returns the runs of the task taskName of the workspace workSpaceName
+func (lenc *Lencak) TaskRuns(workSpaceName, taskName string) ([]*TaskRun, error) {
+	ws, err := lenc.workspace(workSpaceName)
+	if err != nil {
+		return nil, err
+	}
+	lenc.mu.RLock()
+	task := ws.Tasks[taskName]
+	lenc.mu.RUnlock()
+	if task == nil {
+		return nil, notFound("task %s not found in workspace %s", taskName, workSpaceName)
+	}
+
+	task.activeMu.Lock()
+	defer task.activeMu.Unlock()
+	return append([]*TaskRun{}, task.TaskRuns...), nil
+}
+
+// FunctionRuns returns the runs of a function with their output
+func (lenc *Lencak) FunctionRuns(workSpaceName, functionName string) ([]*TaskRun, error) {
+	ws, err := lenc.workspace(workSpaceName)
+	if err != nil {
+		return nil, err
+	}
+	lenc.mu.RLock()
+	fn := ws.Functions[functionName]
+	lenc.mu.RUnlock()
+	if fn == nil {
+		return nil, notFound("function %s not found in workspace %s", functionName, workSpaceName)
+	}
+	return fn.runs(), nil
 }
 
 // Stop task
-func (lenc *Lencak) StopTask(workSpaceName, taskName string, disableService bool) bool {
-	return lenc.WithWorkspaceTask(workSpaceName, taskName, func(task *Task) {
+func (lenc *Lencak) StopTask(workSpaceName, taskName string, disableService bool) error {
+	return lenc.withUnlockedTask(workSpaceName, taskName, "stop", func(task *Task) error {
 		task.serviceMu.Lock()
 		defer task.serviceMu.Unlock()
 		if task.Service && disableService {
@@ -46,15 +134,199 @@ func (lenc *Lencak) StopTask(workSpaceName, taskName string, disableService bool
 			log.Infof("disabling service %s in workspace %s", taskName, workSpaceName)
 		}
 		task.Stop()
+		return nil
+	})
+}
+
+// ScaleTask sets the number of instances of the task taskName to replicas, see
+// Task.Scale
+func (lenc *Lencak) ScaleTask(workSpaceName, taskName string, replicas int) error {
+	return lenc.withUnlockedTask(workSpaceName, taskName, "scale", func(task *Task) error {
+		if err := task.Scale(lenc.sync, replicas); err != nil {
+			return err
+		}
+		lenc.notify()
+		return nil
+	})
+}
+
+// SignalTask sends the signal named signal, e.g sighup, to the running task
+func (lenc *Lencak) SignalTask(workSpaceName, taskName, signal string) error {
+	return lenc.withUnlockedTask(workSpaceName, taskName, "signal", func(task *Task) error {
+		return task.Signal(signal)
+	})
+}
+
+// ReloadTask reloads the running task taskName of the workspace workSpaceName,
+// see Task.Reload
+func (lenc *Lencak) ReloadTask(workSpaceName, taskName string) error {
+	return lenc.withUnlockedTask(workSpaceName, taskName, "reload", func(task *Task) error {
+		if err := task.Reload(lenc.sync); err != nil {
+			return err
+		}
+		lenc.notify()
+		return nil
 	})
 }
 
+// withUnlockedTask calls f with the task taskName of the workspace workSpaceName
+// unless the workspace is locked, action names f in the errors and events
+func (lenc *Lencak) withUnlockedTask(workSpaceName, taskName, action string, f func(*Task) error) error {
+	ws, err := lenc.workspace(workSpaceName)
+	if err != nil {
+		return err
+	}
+	lenc.mu.RLock()
+	task := ws.Tasks[taskName]
+	lenc.mu.RUnlock()
+	if task == nil {
+		return notFound("task %s not found in workspace %s", taskName, workSpaceName)
+	}
+
+	if _, err := lenc.unlockedWorkspace(workSpaceName, action+" "+taskName); err != nil {
+		return err
+	}
+	return f(task)
+}
+
+// unlockedWorkspace returns the workspace named name, a LockedError is returned
+// and an event describing action is added to the workspace when it's locked
+func (lenc *Lencak) unlockedWorkspace(name, action string) (*Workspace, error) {
+	ws, err := lenc.workspace(name)
+	if err != nil {
+		return nil, err
+	}
+	if lock := ws.CurrentLock(); lock != nil {
+		ws.AddEvent("Refused to %s: %s", action, lock)
+		lenc.notify()
+		return nil, &LockedError{Workspace: name, Lock: lock}
+	}
+	return ws, nil
+}
+
+// workspace returns the workspace named name
+func (lenc *Lencak) workspace(name string) (*Workspace, error) {
+	lenc.mu.RLock()
+	defer lenc.mu.RUnlock()
+	ws, ok := lenc.workspaces[name]
+	if !ok {
+		return nil, notFound("workspace %s not found", name)
+	}
+	return ws, nil
+}
+
+// LockWorkspace locks the workspace workSpaceName for owner, see Workspace.Lock
+func (lenc *Lencak) LockWorkspace(workSpaceName, owner, reason string, ttl time.Duration) (*Lock, error) {
+	ws, err := lenc.workspace(workSpaceName)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := ws.Lock(owner, reason, ttl)
+	if err == nil {
+		lenc.notify()
+	}
+	return lock, err
+}
+
+// UnlockWorkspace releases the lock of the workspace workSpaceName, see Workspace.Unlock
+func (lenc *Lencak) UnlockWorkspace(workSpaceName, owner string, force bool) error {
+	ws, err := lenc.workspace(workSpaceName)
+	if err != nil {
+		return err
+	}
+	err = ws.Unlock(owner, force)
+	if err == nil {
+		lenc.notify()
+	}
+	return err
+}
+
 func (lenc *Lencak) WithWorkspaceTask(workSpaceName, taskName string, f func(*Task)) bool {
-	if _, ok := lenc.workspaces[workSpaceName]; ok {
-		if task, ok := lenc.workspaces[workSpaceName].Tasks[taskName]; ok {
-			f(task)
-			return true
+	lenc.mu.RLock()
+	var task *Task
+	if ws, ok := lenc.workspaces[workSpaceName]; ok {
+		task = ws.Tasks[taskName]
+	}
+	lenc.mu.RUnlock()
+
+	if task == nil {
+		return false
+	}
+	f(task)
+	return true
+}
+
+// CallFunction starts a run of the function functionName of the workspace
+// workSpaceName with args, the run gets the environment of the workspace
+func (lenc *Lencak) CallFunction(workSpaceName, functionName string, args map[string]string) (*TaskRun, error) {
+	ws, err := lenc.workspace(workSpaceName)
+	if err != nil {
+		return nil, err
+	}
+	lenc.mu.RLock()
+	fn := ws.Functions[functionName]
+	env := make(map[string]string)
+	for k, v := range ws.Environment {
+		env[k] = v
+	}
+	lenc.mu.RUnlock()
+
+	if fn == nil {
+		return nil, notFound("function %s not found in workspace %s", functionName, workSpaceName)
+	}
+
+	exitCh := make(chan int, 1)
+	tr, err := fn.Call(args, AddDefaultVars(env), exitCh)
+	if err != nil {
+		return nil, err
+	}
+	lenc.notify()
+	go func() {
+		<-exitCh
+		lenc.notify()
+	}()
+	return tr, nil
+}
+
+// Shutdown stops every running task in all workspaces. The services are switched
+// off and the runs taken from their instances first so that none is restarted,
+// then the tasks stop in parallel and the runs still running after stopTimeout
+// are killed.
+func (lenc *Lencak) Shutdown() {
+	lenc.mu.RLock()
+	stopping := make(map[*Task][]*TaskRun)
+	for _, ws := range lenc.workspaces {
+		for _, t := range ws.Tasks {
+			t.serviceMu.Lock()
+			t.Service = false
+			t.serviceMu.Unlock()
+			if runs := t.takeRuns(); len(runs) > 0 {
+				stopping[t] = runs
+			}
 		}
 	}
-	return false
+	lenc.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for t, runs := range stopping {
+		wg.Add(1)
+		go t.stopRuns(runs)
+		go func(t *Task, runs []*TaskRun) {
+			defer wg.Done()
+			t.awaitRuns(ctx, runs)
+		}(t, runs)
+	}
+	wg.Wait()
+	os.RemoveAll(outputDir())
+}
+
+// notify tells connected clients that the state of lencak changed
+func (lenc *Lencak) notify() {
+	select {
+	case lenc.sync <- true:
+	default:
+		log.Info("failed sending sync event")
+	}
 }
@@ -0,0 +1,279 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LoadConfig parses the workspace files and the files they include, merges the
+// workspaces declared in several files and validates the result. All the errors
+// found are returned as ValidationErrors, with the warnings. Warnings alone are
+// logged and don't fail the load, see CheckConfig.
+//
+// Files are loaded in the given order, the files included by a file are loaded
+// right after it in the order of the include list, the files matched by a glob
+// are sorted by name. A file is only loaded once. An included file without a
+// name contributes to the workspace including it.
+//
+// When several files declare the same workspace name they are merged in load order:
+//   - environment variables of a later file override those of an earlier one
+//   - tasks are appended, declaring the same task name twice is an error
+//   - functions are added, declaring the same function name twice is an error
+//   - columns are merged by column, a group declared twice is replaced by the later one
+//   - the environment is inherited when any of the files sets inherit_environment
+//   - defaults are deep merged, see mergeConfig
+//   - templates are added, declaring the same template name twice is an error
+//   - profiles are added, declaring the same profile name twice is an error
+//
+// Once merged, the defaults and templates are applied to the tasks of the workspace.
+func LoadConfig(workspaces []string) (map[string]*ConfigWorkspace, error) {
+	config, warnings, err := loadConfig(workspaces)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range warnings {
+		log.Warn(warning.(*ConfigError).text())
+	}
+	return config, nil
+}
+
+// CheckConfig loads the workspace files as LoadConfig does and returns the
+// warnings found instead of logging them
+func CheckConfig(workspaces []string) (ValidationErrors, error) {
+	_, warnings, err := loadConfig(workspaces)
+	return warnings, err
+}
+
+func loadConfig(workspaces []string) (map[string]*ConfigWorkspace, ValidationErrors, error) {
+	l := &workspaceLoader{
+		loaded:     make(map[string]bool),
+		workspaces: make(map[string]*ConfigWorkspace),
+	}
+	for _, conf := range workspaces {
+		for _, cfg := range l.load(conf, nil) {
+			l.add(cfg)
+		}
+	}
+	for _, name := range l.order {
+		cfg := l.workspaces[name]
+		if errs := cfg.resolveTasks(); len(errs) > 0 {
+			l.errs = append(l.errs, errs...)
+			continue
+		}
+		l.errs = append(l.errs, cfg.Validate()...)
+	}
+	errs, warnings := l.errs.split()
+	if len(errs) > 0 {
+		return nil, nil, l.errs
+	}
+
+	return l.workspaces, warnings, nil
+}
+
+// WorkspaceFiles returns the workspace files, *.yml and *.yaml, found in dir
+// sorted by name
+func WorkspaceFiles(dir string) ([]string, error) {
+	var files []string
+	for _, pattern := range []string{"*.yml", "*.yaml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// ConfigFiles returns every file the configuration was loaded from
+func ConfigFiles(config map[string]*ConfigWorkspace) []string {
+	var files []string
+	for _, cfg := range config {
+		for _, f := range cfg.files {
+			if !containsString(files, f) {
+				files = append(files, f)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+type workspaceLoader struct {
+	loaded     map[string]bool
+	workspaces map[string]*ConfigWorkspace
+	order      []string
+	errs       ValidationErrors
+}
+
+// load parses path and the files it includes, parents are the files including
+// path and are used to report include cycles
+func (l *workspaceLoader) load(path string, parents []string) []*ConfigWorkspace {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		l.errs = append(l.errs, err)
+		return nil
+	}
+	for i, parent := range parents {
+		if parent == abs {
+			l.errs = append(l.errs, &ConfigError{
+				File:    parents[len(parents)-1],
+				Message: "include cycle: " + strings.Join(append(parents[i:], abs), " -> "),
+			})
+			return nil
+		}
+	}
+	if l.loaded[abs] {
+		log.Infof("Workspace file %s already loaded, skipping", path)
+		return nil
+	}
+	l.loaded[abs] = true
+
+	log.Infof("Loading workspace file: %s", path)
+	cfg, err := ParseFile(path)
+	if errs, ok := err.(ValidationErrors); ok {
+		l.errs = append(l.errs, errs...)
+		return nil
+	} else if err != nil {
+		l.errs = append(l.errs, err)
+		return nil
+	}
+	if cfg == nil {
+		return nil
+	}
+
+	cfgs := []*ConfigWorkspace{cfg}
+	parents = append(parents[:len(parents):len(parents)], abs)
+	for _, pattern := range cfg.Include {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			l.errs = append(l.errs, &ConfigError{File: path, Message: fmt.Sprintf("invalid include %q: %v", pattern, err)})
+			continue
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			l.errs = append(l.errs, &ConfigError{File: path, Message: fmt.Sprintf("included file %s does not exist", pattern)})
+			continue
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			for _, included := range l.load(match, parents) {
+				if included.Name == "" {
+					included.Name = cfg.Name
+				}
+				cfgs = append(cfgs, included)
+			}
+		}
+	}
+	return cfgs
+}
+
+// add merges cfg into the workspace of the same name
+func (l *workspaceLoader) add(cfg *ConfigWorkspace) {
+	existing, ok := l.workspaces[cfg.Name]
+	if !ok {
+		l.workspaces[cfg.Name] = cfg
+		l.order = append(l.order, cfg.Name)
+		return
+	}
+	log.Infof("Merging workspace %s from %s", cfg.Name, cfg.file)
+	l.errs = append(l.errs, existing.merge(cfg)...)
+}
+
+// merge merges other into cfg, see LoadConfig for the merge semantic
+func (cfg *ConfigWorkspace) merge(other *ConfigWorkspace) ValidationErrors {
+	var errs ValidationErrors
+
+	if cfg.Environment == nil {
+		cfg.Environment = make(map[string]string)
+	}
+	for k, v := range other.Environment {
+		cfg.Environment[k] = v
+	}
+
+	cfg.Tasks = append(cfg.Tasks, other.Tasks...)
+
+	if cfg.Functions == nil {
+		cfg.Functions = make(map[string]*ConfigFunction)
+	}
+	for name, fn := range other.Functions {
+		if _, ok := cfg.Functions[name]; ok {
+			errs = append(errs, &ConfigError{
+				File:    other.file,
+				Message: fmt.Sprintf("function %q already declared in workspace %s", name, cfg.Name),
+			})
+			continue
+		}
+		cfg.Functions[name] = fn
+	}
+
+	if cfg.Columns == nil {
+		cfg.Columns = make(map[string]map[string][]string)
+	}
+	for column, groups := range other.Columns {
+		if cfg.Columns[column] == nil {
+			cfg.Columns[column] = make(map[string][]string)
+		}
+		for group, tasks := range groups {
+			cfg.Columns[column][group] = tasks
+		}
+	}
+
+	if other.Defaults != nil {
+		if cfg.Defaults == nil {
+			cfg.Defaults = &ConfigTask{}
+		}
+		mergeConfig(cfg.Defaults, other.Defaults)
+	}
+
+	if cfg.Templates == nil {
+		cfg.Templates = make(map[string]*ConfigTask)
+	}
+	for name, tmpl := range other.Templates {
+		if _, ok := cfg.Templates[name]; ok {
+			errs = append(errs, &ConfigError{
+				File:    other.file,
+				Message: fmt.Sprintf("template %q already declared in workspace %s", name, cfg.Name),
+			})
+			continue
+		}
+		cfg.Templates[name] = tmpl
+	}
+
+	if cfg.Profiles == nil {
+		cfg.Profiles = make(map[string]*ConfigProfile)
+	}
+	for name, profile := range other.Profiles {
+		if _, ok := cfg.Profiles[name]; ok {
+			errs = append(errs, &ConfigError{
+				File:    other.file,
+				Message: fmt.Sprintf("profile %q already declared in workspace %s", name, cfg.Name),
+			})
+			continue
+		}
+		cfg.Profiles[name] = profile
+	}
+
+	if cfg.Pipelines == nil {
+		cfg.Pipelines = make(map[string]*ConfigPipeline)
+	}
+	for name, pipeline := range other.Pipelines {
+		if _, ok := cfg.Pipelines[name]; ok {
+			errs = append(errs, &ConfigError{
+				File:    other.file,
+				Message: fmt.Sprintf("pipeline %q already declared in workspace %s", name, cfg.Name),
+			})
+			continue
+		}
+		cfg.Pipelines[name] = pipeline
+	}
+
+	cfg.InheritEnvironment = cfg.InheritEnvironment || other.InheritEnvironment
+	cfg.files = append(cfg.files, other.files...)
+	cfg.warnings = append(cfg.warnings, other.warnings...)
+
+	return errs
+}
@@ -0,0 +1,116 @@
+package app
+
+import (
+	"fmt"
+	"time"
+)
+
+// Lock prevents the tasks of a workspace from being started, stopped or signaled
+type Lock struct {
+	Owner   string    `json:"owner"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	// the lock never expires when Expires is zero
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (l *Lock) String() string {
+	s := "locked by " + l.Owner
+	if !l.Expires.IsZero() {
+		s += " until " + l.Expires.Format(time.RFC3339)
+	}
+	if l.Reason != "" {
+		s += ": " + l.Reason
+	}
+	return s
+}
+
+func (l *Lock) expired(now time.Time) bool {
+	return !l.Expires.IsZero() && !now.Before(l.Expires)
+}
+
+// LockedError is returned when an action is refused because the workspace is locked
+type LockedError struct {
+	Workspace string
+	Lock      *Lock
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("workspace %s is %s", e.Workspace, e.Lock)
+}
+
+// NotFoundError is returned when a workspace, a task or a function doesn't exist
+type NotFoundError struct {
+	Message string
+}
+
+func (e *NotFoundError) Error() string {
+	return e.Message
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &NotFoundError{Message: fmt.Sprintf(format, args...)}
+}
+
+// CurrentLock returns the lock of the workspace, or nil when the workspace is not
+// locked. An expired lock is released.
+func (ws *Workspace) CurrentLock() *Lock {
+	ws.lockMu.Lock()
+	defer ws.lockMu.Unlock()
+	if ws.lock != nil && ws.lock.expired(time.Now()) {
+		ws.lock = nil
+		ws.AddEvent("Lock expired")
+	}
+	return ws.lock
+}
+
+// IsLocked returns true when the workspace is locked
+func (ws *Workspace) IsLocked() bool {
+	return ws.CurrentLock() != nil
+}
+
+// Lock locks the workspace for owner, the lock expires after ttl unless ttl is 0.
+// The owner of the lock can lock the workspace again to change the reason or the
+// expiry of the lock.
+func (ws *Workspace) Lock(owner, reason string, ttl time.Duration) (*Lock, error) {
+	if owner == "" {
+		return nil, fmt.Errorf("a lock requires an owner")
+	}
+	current := ws.CurrentLock()
+
+	ws.lockMu.Lock()
+	if current != nil && current.Owner != owner {
+		ws.lockMu.Unlock()
+		return nil, &LockedError{Workspace: ws.Name, Lock: current}
+	}
+	lock := &Lock{Owner: owner, Reason: reason, Created: time.Now()}
+	if ttl > 0 {
+		lock.Expires = lock.Created.Add(ttl)
+	}
+	ws.lock = lock
+	ws.lockMu.Unlock()
+
+	ws.AddEvent("Workspace %s", lock)
+	return lock, nil
+}
+
+// Unlock releases the lock of the workspace, only the owner of the lock can
+// release it unless force is true
+func (ws *Workspace) Unlock(owner string, force bool) error {
+	current := ws.CurrentLock()
+
+	ws.lockMu.Lock()
+	if current == nil {
+		ws.lockMu.Unlock()
+		return nil
+	}
+	if current.Owner != owner && !force {
+		ws.lockMu.Unlock()
+		return &LockedError{Workspace: ws.Name, Lock: current}
+	}
+	ws.lock = nil
+	ws.lockMu.Unlock()
+
+	ws.AddEvent("Workspace unlocked by %s", owner)
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io/ioutil"
 	"os"
+	"sync"
 )
 
 // LogWriter is a log writer
@@ -60,29 +61,37 @@ func (flw FileLogWriter) Len() int64 {
 	return 0
 }
 
-// InMemoryLogWriter is an in memory log writer
+// InMemoryLogWriter is an in memory log writer, its content can be read while
+// the process writes it
 type InMemoryLogWriter struct {
 	buffer *bytes.Buffer
+	mu     *sync.Mutex
 }
 
 // NewInMemoryLogWriter returns a new InMemoryLogWriter
 func NewInMemoryLogWriter() InMemoryLogWriter {
 	imlw := InMemoryLogWriter{}
 	imlw.buffer = new(bytes.Buffer)
+	imlw.mu = new(sync.Mutex)
 	return imlw
 }
 
 func (imlw InMemoryLogWriter) Write(p []byte) (n int, err error) {
+	imlw.mu.Lock()
+	defer imlw.mu.Unlock()
 	return imlw.buffer.Write(p)
 }
 
-//
 func (imlw InMemoryLogWriter) String() string {
+	imlw.mu.Lock()
+	defer imlw.mu.Unlock()
 	return imlw.buffer.String()
 }
 
 // Len returns the length of the content
 func (imlw InMemoryLogWriter) Len() int64 {
+	imlw.mu.Lock()
+	defer imlw.mu.Unlock()
 	return int64(imlw.buffer.Len())
 }
 
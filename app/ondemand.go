@@ -0,0 +1,164 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultIdleTimeout is the time an on-demand task runs without traffic
+	// before it's stopped when the task doesn't set one
+	defaultIdleTimeout = 15 * time.Minute
+
+	// activationTimeout is the time given to an on-demand task to accept
+	// connections once started
+	activationTimeout = 30 * time.Second
+)
+
+// idleTimeout returns the time the on-demand task runs without traffic before
+// it's stopped
+func (t *Task) idleTimeout() time.Duration {
+	if d, err := time.ParseDuration(t.Config.IdleTimeout); err == nil && d > 0 {
+		return d
+	}
+	return defaultIdleTimeout
+}
+
+// connected records a connection to the task through the proxy, the returned
+// function records its end. A stop of the task for being idle in progress is
+// waited for, none starts while the connection lasts.
+func (t *Task) connected() func() {
+	t.demandMu.Lock()
+	t.connections++
+	t.lastActivity = time.Now()
+	stopping := t.idleStop
+	t.demandMu.Unlock()
+
+	if stopping != nil {
+		<-stopping
+	}
+	return func() {
+		t.demandMu.Lock()
+		t.connections--
+		t.lastActivity = time.Now()
+		t.demandMu.Unlock()
+	}
+}
+
+// beginIdleStop reserves the stop of the task when it had no connection for its
+// idle timeout, the start of its last run counts as activity. The returned
+// channel must be closed by endIdleStop once the task stopped, nil is returned
+// when the task isn't idle or is already stopping.
+func (t *Task) beginIdleStop() chan struct{} {
+	last := time.Time{}
+	if run := t.LastRun(); run != nil {
+		last = run.Started
+	}
+	t.demandMu.Lock()
+	defer t.demandMu.Unlock()
+	if t.connections > 0 || t.idleStop != nil {
+		return nil
+	}
+	if t.lastActivity.After(last) {
+		last = t.lastActivity
+	}
+	if time.Since(last) <= t.idleTimeout() {
+		return nil
+	}
+	t.idleStop = make(chan struct{})
+	return t.idleStop
+}
+
+// endIdleStop releases the stop reserved by beginIdleStop
+func (t *Task) endIdleStop(stopping chan struct{}) {
+	t.demandMu.Lock()
+	t.idleStop = nil
+	t.demandMu.Unlock()
+	close(stopping)
+}
+
+// activate starts the on-demand task taskName and the tasks it depends on, then
+// waits until every instance of the task accepts connections. Another operation
+// running on the workspace, e.g a concurrent activation, is waited for.
+func (lenc *Lencak) activate(workSpaceName, taskName string) error {
+	operation := "start " + taskName + " on demand"
+	deadline := time.Now().Add(activationTimeout)
+	var task *Task
+	for {
+		ws, levels, err := lenc.operationLevels(workSpaceName, operation, true, func(*Workspace) ([]string, error) {
+			return []string{taskName}, nil
+		})
+		if err != nil {
+			return err
+		}
+		task = levels[len(levels)-1][0]
+		if task.Running() {
+			break
+		}
+		_, err = lenc.runOperation(ws, operation, nil, levels)
+		if err == nil {
+			break
+		}
+		if _, busy := err.(*BusyError); !busy {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	name := task.proxyPortVar()
+	for time.Now().Before(deadline) {
+		runs := task.activeRuns()
+		if len(runs) == 0 {
+			if run := task.LastRun(); run != nil && runError(run) != nil {
+				return fmt.Errorf("task %s failed to start: %v", taskName, runError(run))
+			}
+		}
+		ready := len(runs) > 0
+		for _, run := range runs {
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", run.Environment[name]), time.Second)
+			if err != nil {
+				ready = false
+				break
+			}
+			conn.Close()
+		}
+		if ready {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("task %s did not accept connections after %s", taskName, activationTimeout)
+}
+
+// stopIdleTasks stops the running on-demand tasks that had no traffic for their
+// idle timeout, every interval
+func (lenc *Lencak) stopIdleTasks(interval time.Duration) {
+	for range time.Tick(interval) {
+		lenc.mu.RLock()
+		for _, ws := range lenc.workspaces {
+			for _, t := range ws.Tasks {
+				if !t.Config.OnDemand || !t.Running() {
+					continue
+				}
+				stopping := t.beginIdleStop()
+				if stopping == nil {
+					continue
+				}
+				log.Infof("on-demand task %s of workspace %s is idle, stopping it", t.Name, ws.Name)
+				ws.AddEvent("Task %s idle for %s, stopping it", t.Name, t.idleTimeout())
+				go func(t *Task) {
+					defer t.endIdleStop(stopping)
+					t.stopWithin(stopTimeout)
+					lenc.notify()
+				}(t)
+			}
+		}
+		lenc.mu.RUnlock()
+	}
+}
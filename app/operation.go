@@ -0,0 +1,465 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TaskResult is the progress of an operation on one task
+type TaskResult struct {
+	Task string `json:"task"`
+	// pending, stopping or starting while the operation runs, then ok, failed or
+	// skipped
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// OperationResult is the progress of an operation on several tasks of a
+// workspace, it succeeds when the operation succeeded on every task
+type OperationResult struct {
+	Workspace string
+	Operation string
+	Tasks     []*TaskResult
+	Success   bool
+	Done      bool
+	Started   time.Time
+	Finished  time.Time
+
+	mu     sync.Mutex
+	tasks  map[string]*TaskResult
+	notify func()
+	// the operation that ran before, restored when the operation is canceled
+	previous *OperationResult
+}
+
+// BusyError is returned when an operation is refused because another operation
+// is running on the workspace
+type BusyError struct {
+	Workspace string
+	Operation string
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("workspace %s is busy: %s in progress", e.Workspace, e.Operation)
+}
+
+func (r *OperationResult) MarshalJSON() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tasks := make([]TaskResult, len(r.Tasks))
+	for i, t := range r.Tasks {
+		tasks[i] = *t
+	}
+	var finished *time.Time
+	if r.Done {
+		finished = &r.Finished
+	}
+	return json.Marshal(&struct {
+		Workspace string       `json:"workspace"`
+		Operation string       `json:"operation"`
+		Tasks     []TaskResult `json:"tasks"`
+		Success   bool         `json:"success"`
+		Done      bool         `json:"done"`
+		Started   time.Time    `json:"started"`
+		Finished  *time.Time   `json:"finished,omitempty"`
+	}{
+		Workspace: r.Workspace,
+		Operation: r.Operation,
+		Tasks:     tasks,
+		Success:   r.Success,
+		Done:      r.Done,
+		Started:   r.Started,
+		Finished:  finished,
+	})
+}
+
+// set updates the progress of the operation on the task named name
+func (r *OperationResult) set(name, status string, err error) {
+	r.mu.Lock()
+	t := r.tasks[name]
+	t.Status = status
+	t.Error = ""
+	if err != nil {
+		t.Error = err.Error()
+	}
+	r.mu.Unlock()
+	r.notify()
+}
+
+func (r *OperationResult) status(name string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tasks[name].Status
+}
+
+func (r *OperationResult) finish() {
+	r.mu.Lock()
+	r.Success = true
+	for _, t := range r.Tasks {
+		if t.Status != "ok" {
+			r.Success = false
+		}
+	}
+	r.Done = true
+	r.Finished = time.Now()
+	r.mu.Unlock()
+	r.notify()
+}
+
+func (r *OperationResult) summary() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := make(map[string]int)
+	for _, t := range r.Tasks {
+		counts[t.Status]++
+	}
+	if r.Success {
+		return fmt.Sprintf("%d tasks ok", counts["ok"])
+	}
+	return fmt.Sprintf("%d tasks ok, %d failed, %d skipped", counts["ok"], counts["failed"], counts["skipped"])
+}
+
+// CurrentOperation returns the running operation of the workspace or the last
+// one, nil when no operation ran
+func (ws *Workspace) CurrentOperation() *OperationResult {
+	ws.operationMu.Lock()
+	defer ws.operationMu.Unlock()
+	return ws.operation
+}
+
+// StartWorkspace starts the tasks starting with the workspace, the services or
+// the tasks of the active profile, see autoStarted and startTasks
+func (lenc *Lencak) StartWorkspace(workSpaceName string) (*OperationResult, error) {
+	ws, levels, err := lenc.workspaceLevels(workSpaceName, "start", false)
+	if err != nil {
+		return nil, err
+	}
+	return lenc.runOperation(ws, "start workspace", nil, levels)
+}
+
+// StopWorkspace stops every task of the workspace, see stopTasks
+func (lenc *Lencak) StopWorkspace(workSpaceName string) (*OperationResult, error) {
+	ws, levels, err := lenc.workspaceLevels(workSpaceName, "stop", true)
+	if err != nil {
+		return nil, err
+	}
+	return lenc.runOperation(ws, "stop workspace", levels, nil)
+}
+
+// RestartWorkspace stops the tasks starting with the workspace then starts them
+// again, see StartWorkspace
+func (lenc *Lencak) RestartWorkspace(workSpaceName string) (*OperationResult, error) {
+	ws, levels, err := lenc.workspaceLevels(workSpaceName, "restart", false)
+	if err != nil {
+		return nil, err
+	}
+	return lenc.runOperation(ws, "restart workspace", levels, levels)
+}
+
+// workspaceLevels returns the dependency levels of every task of the workspace
+// when all is true, of the tasks starting with the workspace otherwise
+func (lenc *Lencak) workspaceLevels(workSpaceName, action string, all bool) (*Workspace, [][]*Task, error) {
+	return lenc.operationLevels(workSpaceName, action+" workspace", false, func(ws *Workspace) ([]string, error) {
+		autoStarted := ws.autoStarted()
+		names := make([]string, 0, len(ws.Tasks))
+		for name := range ws.Tasks {
+			if all || autoStarted[name] {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	})
+}
+
+// operationLevels returns the dependency levels of the tasks of the workspace
+// selected by selectTasks unless the workspace is locked, action describes the
+// operation in the events of the workspace
+func (lenc *Lencak) operationLevels(workSpaceName, action string, withDeps bool, selectTasks func(*Workspace) ([]string, error)) (*Workspace, [][]*Task, error) {
+	ws, err := lenc.unlockedWorkspace(workSpaceName, action)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lenc.mu.RLock()
+	defer lenc.mu.RUnlock()
+	names, err := selectTasks(ws)
+	if err != nil {
+		return nil, nil, err
+	}
+	levels, err := dependencyLevels(ws.Tasks, names, withDeps)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ws, levels, nil
+}
+
+// runOperation stops the tasks of stop, then starts the tasks of start, either
+// may be empty. The progress of the operation is published on the workspace, a
+// BusyError is returned when another operation runs on the workspace.
+func (lenc *Lencak) runOperation(ws *Workspace, operation string, stop, start [][]*Task) (*OperationResult, error) {
+	result, err := lenc.beginOperation(ws, operation)
+	if err != nil {
+		return nil, err
+	}
+	lenc.continueOperation(ws, result, stop, start)
+	return result, nil
+}
+
+// beginOperation reserves the workspace for operation, a BusyError is returned
+// when another operation runs on the workspace. The operation must then be run
+// by continueOperation, or canceled by cancelOperation.
+func (lenc *Lencak) beginOperation(ws *Workspace, operation string) (*OperationResult, error) {
+	result := &OperationResult{
+		Workspace: ws.Name,
+		Operation: operation,
+		Started:   time.Now(),
+		tasks:     make(map[string]*TaskResult),
+		notify:    lenc.notify,
+	}
+
+	ws.operationMu.Lock()
+	defer ws.operationMu.Unlock()
+	if current := ws.operation; current != nil && !current.Done {
+		return nil, &BusyError{Workspace: ws.Name, Operation: current.Operation}
+	}
+	result.previous = ws.operation
+	ws.operation = result
+	return result, nil
+}
+
+// cancelOperation releases the workspace reserved by beginOperation without
+// running the operation
+func (lenc *Lencak) cancelOperation(ws *Workspace, result *OperationResult) {
+	ws.operationMu.Lock()
+	defer ws.operationMu.Unlock()
+	if ws.operation == result {
+		ws.operation = result.previous
+	}
+}
+
+// continueOperation runs the operation reserved by beginOperation, see
+// runOperation
+func (lenc *Lencak) continueOperation(ws *Workspace, result *OperationResult, stop, start [][]*Task) {
+	result.mu.Lock()
+	for _, levels := range [][][]*Task{start, stop} {
+		for _, level := range levels {
+			for _, task := range level {
+				if _, ok := result.tasks[task.Name]; !ok {
+					t := &TaskResult{Task: task.Name, Status: "pending"}
+					result.tasks[task.Name] = t
+					result.Tasks = append(result.Tasks, t)
+				}
+			}
+		}
+	}
+	result.previous = nil
+	result.mu.Unlock()
+	lenc.notify()
+
+	restarted := make(map[string]bool)
+	for _, level := range start {
+		for _, task := range level {
+			restarted[task.Name] = true
+		}
+	}
+	lenc.stopTasks(result, stop, restarted)
+	lenc.startTasks(ws, result, start)
+	result.finish()
+	ws.AddEvent("%s: %s", result.Operation, result.summary())
+}
+
+// dependencyLevels sorts the tasks names, and the tasks they depend on when
+// withDeps is true, into levels: the tasks of a level only depend on tasks of
+// previous levels. Dependencies on tasks left out are ignored.
+func dependencyLevels(tasks map[string]*Task, names []string, withDeps bool) ([][]*Task, error) {
+	selected := make(map[string]*Task)
+	var add func(name string) error
+	add = func(name string) error {
+		if _, ok := selected[name]; ok {
+			return nil
+		}
+		task, ok := tasks[name]
+		if !ok {
+			return notFound("task %s not found", name)
+		}
+		selected[name] = task
+		if !withDeps {
+			return nil
+		}
+		for _, dep := range task.DependsOn {
+			if err := add(dep); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, name := range names {
+		if err := add(name); err != nil {
+			return nil, err
+		}
+	}
+
+	var levels [][]*Task
+	placed := make(map[string]bool)
+	for len(placed) < len(selected) {
+		var level []*Task
+		for name, task := range selected {
+			if placed[name] {
+				continue
+			}
+			ready := true
+			for _, dep := range task.DependsOn {
+				if _, ok := selected[dep]; ok && !placed[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				level = append(level, task)
+			}
+		}
+		if len(level) == 0 {
+			var left []string
+			for name := range selected {
+				if !placed[name] {
+					left = append(left, name)
+				}
+			}
+			sort.Strings(left)
+			return nil, fmt.Errorf("dependency cycle between %s", strings.Join(left, ", "))
+		}
+		sort.Slice(level, func(i, j int) bool { return level[i].Name < level[j].Name })
+		for _, task := range level {
+			placed[task.Name] = true
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// startTasks starts the tasks level by level, the tasks of a level start in
+// parallel once every task of the previous level is ready. A service is ready
+// once its process started, any other task once it exited successfully. A task
+// is skipped when one of its dependencies failed.
+func (lenc *Lencak) startTasks(ws *Workspace, result *OperationResult, levels [][]*Task) {
+	failed := make(map[string]bool)
+	for _, level := range levels {
+		var wg sync.WaitGroup
+		for _, task := range level {
+			if dep := failedDependency(task, failed); dep != "" {
+				result.set(task.Name, "skipped", fmt.Errorf("dependency %s did not start", dep))
+				continue
+			}
+			wg.Add(1)
+			go func(task *Task) {
+				defer wg.Done()
+				result.set(task.Name, "starting", nil)
+				opts := &RunOptions{outputs: lenc.dependencyOutputs(ws.Name, task)}
+				if _, err := lenc.startAndWait(task, opts); err != nil {
+					result.set(task.Name, "failed", err)
+					return
+				}
+				result.set(task.Name, "ok", nil)
+			}(task)
+		}
+		wg.Wait()
+
+		for _, task := range level {
+			if status := result.status(task.Name); status != "ok" {
+				failed[task.Name] = true
+				ws.AddEvent("%s: %s %s: %s", result.Operation, task.Name, status, result.tasks[task.Name].Error)
+			}
+		}
+	}
+}
+
+// stopTasks stops the tasks level by level in the reverse order of the levels,
+// the tasks of a level stop in parallel. A task stopped is pending when it's
+// restarted by the operation, ok otherwise.
+func (lenc *Lencak) stopTasks(result *OperationResult, levels [][]*Task, restarted map[string]bool) {
+	for i := len(levels) - 1; i >= 0; i-- {
+		var wg sync.WaitGroup
+		for _, task := range levels[i] {
+			wg.Add(1)
+			go func(task *Task) {
+				defer wg.Done()
+				result.set(task.Name, "stopping", nil)
+				task.Shutdown(stopTimeout)
+				if restarted[task.Name] {
+					result.set(task.Name, "pending", nil)
+				} else {
+					result.set(task.Name, "ok", nil)
+				}
+			}(task)
+		}
+		wg.Wait()
+	}
+}
+
+// failedDependency returns the name of a dependency of task in failed, an empty
+// string when none failed
+func failedDependency(task *Task, failed map[string]bool) string {
+	for _, dep := range task.DependsOn {
+		if failed[dep] {
+			return dep
+		}
+	}
+	return ""
+}
+
+// startAndWait starts the instances of the task that are not running with opts
+// and waits until every instance is ready: a service once its process started,
+// any other task once it exited, after its last attempt when it retries failed
+// runs. The runs waited for are returned.
+func (lenc *Lencak) startAndWait(task *Task, opts *RunOptions) ([]*TaskRun, error) {
+	service := task.Config != nil && task.Config.Service
+	if service {
+		task.serviceMu.Lock()
+		task.Service = true
+		task.serviceMu.Unlock()
+	}
+	runs, _, err := task.startInstances(lenc.sync, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		runs = task.activeRuns()
+	}
+	if len(runs) == 0 {
+		return nil, fmt.Errorf("task %s did not start", task.Name)
+	}
+	for i, run := range runs {
+		if service {
+			select {
+			case <-run.done:
+				// a run retried did not fail yet
+				if err := runError(run); err != nil && !run.isRetrying() {
+					return runs, err
+				}
+			default:
+			}
+			continue
+		}
+		runs[i] = run.WaitAttempts()
+		if err := runError(runs[i]); err != nil {
+			return runs, err
+		}
+	}
+	return runs, nil
+}
+
+// runError returns the error of a run that exited, nil when it succeeded
+func runError(run *TaskRun) error {
+	if run.Error != nil {
+		return run.Error
+	}
+	if status := run.WaitStatus.ExitStatus(); status != 0 {
+		return fmt.Errorf("exited with status %d", status)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// outputDir returns the directory of the $LENCAK_OUTPUT files, removed when
+// lencak shuts down
+func outputDir() string {
+	return filepath.Join(os.TempDir(), "lencak-"+strconv.Itoa(os.Getpid()))
+}
+
+// outputFile returns the $LENCAK_OUTPUT file of the run numbered run of the task
+func (t *Task) outputFile(run int) string {
+	return filepath.Join(outputDir(), t.Environment["WORKSPACE"], fmt.Sprintf("%s-%d.output", t.Name, run))
+}
+
+// setOutputFile makes path the $LENCAK_OUTPUT file of the run
+func (tr *TaskRun) setOutputFile(path string) {
+	tr.outputFile = path
+	tr.Environment["LENCAK_OUTPUT"] = path
+}
+
+// createOutputFile creates the empty $LENCAK_OUTPUT file of the run
+func (tr *TaskRun) createOutputFile() error {
+	if tr.outputFile == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(tr.outputFile), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tr.outputFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// readOutputs stores the variables the run wrote to its $LENCAK_OUTPUT file in
+// Outputs then removes the file
+func (tr *TaskRun) readOutputs() {
+	if tr.outputFile == "" {
+		return
+	}
+	f, err := os.Open(tr.outputFile)
+	if err != nil {
+		return
+	}
+	outputs, err := parseOutputs(f)
+	f.Close()
+	os.Remove(tr.outputFile)
+	if err != nil {
+		tr.addEvent("Invalid $LENCAK_OUTPUT: %v", err)
+	}
+	if len(outputs) > 0 {
+		tr.Outputs = outputs
+	}
+}
+
+// parseOutputs parses KEY=VALUE lines, a multiline value is written as
+// KEY<<DELIMITER, the lines of the value, then DELIMITER. The variables parsed
+// before an invalid line are returned with the error.
+func parseOutputs(r io.Reader) (map[string]string, error) {
+	outputs := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		if i := strings.Index(text, "<<"); i > 0 && (!strings.Contains(text, "=") || i < strings.Index(text, "=")) {
+			key, delimiter := text[:i], text[i+2:]
+			if !varNameRe.MatchString(key) || delimiter == "" {
+				return outputs, fmt.Errorf("line %d: invalid output %q", line, text)
+			}
+			var value []string
+			closed := false
+			for scanner.Scan() {
+				line++
+				if scanner.Text() == delimiter {
+					closed = true
+					break
+				}
+				value = append(value, scanner.Text())
+			}
+			if !closed {
+				return outputs, fmt.Errorf("output %s: missing delimiter %s", key, delimiter)
+			}
+			outputs[key] = strings.Join(value, "\n")
+			continue
+		}
+
+		kv := strings.SplitN(text, "=", 2)
+		if len(kv) != 2 || !varNameRe.MatchString(kv[0]) {
+			return outputs, fmt.Errorf("line %d: invalid output %q", line, text)
+		}
+		outputs[kv[0]] = kv[1]
+	}
+	return outputs, scanner.Err()
+}
+
+// dependencyOutputs returns the outputs of the last runs of the tasks the task
+// depends on, in the order of its dependencies
+func (lenc *Lencak) dependencyOutputs(workSpaceName string, task *Task) map[string]string {
+	ws, err := lenc.workspace(workSpaceName)
+	if err != nil {
+		return nil
+	}
+	outputs := make(map[string]string)
+	for _, name := range task.DependsOn {
+		lenc.mu.RLock()
+		dep := ws.Tasks[name]
+		lenc.mu.RUnlock()
+		if dep == nil {
+			continue
+		}
+		if run := dep.LastRun(); run != nil {
+			for k, v := range run.Outputs {
+				outputs[k] = v
+			}
+		}
+	}
+	return outputs
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOutputs(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]string
+		err   string
+	}{
+		{
+			name:  "key value lines",
+			input: "DB=test_1\n\nTOKEN=a=b\nEMPTY=\n",
+			want:  map[string]string{"DB": "test_1", "TOKEN": "a=b", "EMPTY": ""},
+		},
+		{
+			name:  "multiline value",
+			input: "CERT<<EOF\nline 1\nline 2\nEOF\nDB=test\n",
+			want:  map[string]string{"CERT": "line 1\nline 2", "DB": "test"},
+		},
+		{
+			name:  "delimiter after the equal sign is a value",
+			input: "CMD=cat <<EOF\n",
+			want:  map[string]string{"CMD": "cat <<EOF"},
+		},
+		{
+			name:  "missing delimiter",
+			input: "DB=test\nCERT<<EOF\nline 1\n",
+			want:  map[string]string{"DB": "test"},
+			err:   "output CERT: missing delimiter EOF",
+		},
+		{
+			name:  "empty delimiter",
+			input: "CERT<<\n",
+			want:  map[string]string{},
+			err:   `line 1: invalid output "CERT<<"`,
+		},
+		{
+			name:  "line without equal sign",
+			input: "DB=test\nnot an output\nTOKEN=x\n",
+			want:  map[string]string{"DB": "test"},
+			err:   `line 2: invalid output "not an output"`,
+		},
+		{
+			name:  "invalid name",
+			input: "1DB=test\n",
+			want:  map[string]string{},
+			err:   `line 1: invalid output "1DB=test"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseOutputs(strings.NewReader(tt.input))
+			if tt.err == "" && err != nil {
+				t.Errorf("error = %v", err)
+			}
+			if tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("outputs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputsDontOverrideVariables(t *testing.T) {
+	task := NewTask(parseTask(t, "{name: web, command: 'true', environment: {PATH: /bin}}"), map[string]string{"PATH": "/bin"})
+	task.Ports = map[string]int{"PORT": 8000}
+	run := task.NewTaskRun(0, &RunOptions{outputs: map[string]string{
+		"PATH":     "/tmp",
+		"PORT":     "1",
+		"INSTANCE": "9",
+		"DB":       "test",
+	}})
+	want := map[string]string{"PATH": "/bin", "PORT": "8000", "INSTANCE": "0", "DB": "test"}
+	for k, v := range want {
+		if run.Environment[k] != v {
+			t.Errorf("$%s = %q, want %q", k, run.Environment[k], v)
+		}
+	}
+}
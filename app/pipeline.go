@@ -0,0 +1,460 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stageName returns the name of the stage at index i of its pipeline
+func (s *ConfigStage) stageName(i int) string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return "stage " + strconv.Itoa(i+1)
+}
+
+// Pipeline is a named sequence of stages of a workspace, the stages run one
+// after the other and the tasks of a stage run in parallel
+type Pipeline struct {
+	Name   string
+	Stages []*ConfigStage
+
+	mu   sync.Mutex
+	Runs []*PipelineRun
+}
+
+func (p *Pipeline) MarshalJSON() ([]byte, error) {
+	p.mu.Lock()
+	runs := append([]*PipelineRun{}, p.Runs...)
+	stages := p.Stages
+	p.mu.Unlock()
+
+	status := "idle"
+	if len(runs) > 0 {
+		status = runs[len(runs)-1].status()
+	}
+	return json.Marshal(&struct {
+		Name   string         `json:"name"`
+		Stages []*ConfigStage `json:"stages"`
+		Status string         `json:"status"`
+		Runs   []*PipelineRun `json:"runs"`
+	}{
+		Name:   p.Name,
+		Stages: stages,
+		Status: status,
+		Runs:   runs,
+	})
+}
+
+// update copies the stages of other, the runs of the pipeline are kept
+func (p *Pipeline) update(other *Pipeline) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Stages = other.Stages
+}
+
+// running returns the running run of the pipeline, nil when none is. p.mu must
+// be held.
+func (p *Pipeline) running() *PipelineRun {
+	for _, run := range p.Runs {
+		if run.status() == "running" {
+			return run
+		}
+	}
+	return nil
+}
+
+// PipelineRun is a run of a pipeline: running, succeeded, failed or stopped. A
+// failed or stopped run can be retried from the stage that did not succeed.
+type PipelineRun struct {
+	Id       int
+	Pipeline string
+	Status   string
+	Started  time.Time
+	Finished time.Time
+	Stages   []*StageRun
+
+	mu sync.Mutex
+	// closed to stop the run, see StopPipeline
+	stop chan struct{}
+}
+
+// StageRun is the progress of a stage in a pipeline run: pending, running, ok,
+// failed, stopped or skipped
+type StageRun struct {
+	Name     string       `json:"name"`
+	Status   string       `json:"status"`
+	Attempts int          `json:"attempts"`
+	Tasks    []*StageTask `json:"tasks"`
+}
+
+// StageTask is the progress of a task in a stage run, with the ids of the runs
+// of the task started by the last attempt of the stage
+type StageTask struct {
+	Task   string `json:"task"`
+	Status string `json:"status"`
+	Runs   []int  `json:"runs,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (r *PipelineRun) MarshalJSON() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stages := make([]StageRun, len(r.Stages))
+	for i, s := range r.Stages {
+		stages[i] = *s
+		stages[i].Tasks = make([]*StageTask, len(s.Tasks))
+		for j, t := range s.Tasks {
+			task := *t
+			stages[i].Tasks[j] = &task
+		}
+	}
+	var finished *time.Time
+	if !r.Finished.IsZero() {
+		finished = &r.Finished
+	}
+	return json.Marshal(&struct {
+		Id          int        `json:"id"`
+		Pipeline    string     `json:"pipeline"`
+		Status      string     `json:"status"`
+		Correlation string     `json:"correlation"`
+		Started     time.Time  `json:"started"`
+		Finished    *time.Time `json:"finished,omitempty"`
+		Stages      []StageRun `json:"stages"`
+	}{
+		Id:          r.Id,
+		Pipeline:    r.Pipeline,
+		Status:      r.Status,
+		Correlation: r.correlation(),
+		Started:     r.Started,
+		Finished:    finished,
+		Stages:      stages,
+	})
+}
+
+func (r *PipelineRun) status() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Status
+}
+
+// correlation returns the correlation of the runs of the tasks started by the
+// pipeline run
+func (r *PipelineRun) correlation() string {
+	return fmt.Sprintf("pipeline-%s-%d", r.Pipeline, r.Id)
+}
+
+func (r *PipelineRun) stopped() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// setTask updates the progress of the task at index i of the stage
+func (r *PipelineRun) setTask(stage *StageRun, i int, status string, runs []*TaskRun, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := stage.Tasks[i]
+	t.Status = status
+	t.Error = ""
+	if err != nil {
+		t.Error = err.Error()
+	}
+	if runs != nil {
+		t.Runs = make([]int, len(runs))
+		for j, run := range runs {
+			t.Runs[j] = run.Id
+		}
+	}
+}
+
+// pipeline returns the pipeline named name of the workspace unless the workspace
+// is locked, action describes the command in the events of the workspace
+func (lenc *Lencak) pipeline(workSpaceName, name, action string) (*Workspace, *Pipeline, error) {
+	ws, err := lenc.unlockedWorkspace(workSpaceName, action)
+	if err != nil {
+		return nil, nil, err
+	}
+	lenc.mu.RLock()
+	p := ws.Pipelines[name]
+	lenc.mu.RUnlock()
+	if p == nil {
+		return nil, nil, notFound("pipeline %s not found in workspace %s", name, workSpaceName)
+	}
+	return ws, p, nil
+}
+
+// Pipelines returns the pipelines of the workspace workSpaceName with their runs
+func (lenc *Lencak) Pipelines(workSpaceName string) (map[string]*Pipeline, error) {
+	ws, err := lenc.workspace(workSpaceName)
+	if err != nil {
+		return nil, err
+	}
+	lenc.mu.RLock()
+	defer lenc.mu.RUnlock()
+	pipelines := make(map[string]*Pipeline, len(ws.Pipelines))
+	for name, p := range ws.Pipelines {
+		pipelines[name] = p
+	}
+	return pipelines, nil
+}
+
+// StartPipeline starts a run of the pipeline name, a BusyError is returned when
+// the pipeline is running
+func (lenc *Lencak) StartPipeline(workSpaceName, name string) (*PipelineRun, error) {
+	ws, p, err := lenc.pipeline(workSpaceName, name, "start pipeline "+name)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	if p.running() != nil {
+		p.mu.Unlock()
+		return nil, &BusyError{Workspace: ws.Name, Operation: "pipeline " + name}
+	}
+	run := &PipelineRun{
+		Id:       len(p.Runs),
+		Pipeline: name,
+		Status:   "running",
+		Started:  time.Now(),
+		stop:     make(chan struct{}),
+	}
+	for i, stage := range p.Stages {
+		s := &StageRun{Name: stage.stageName(i), Status: "pending"}
+		for _, task := range stage.Tasks {
+			s.Tasks = append(s.Tasks, &StageTask{Task: task, Status: "pending"})
+		}
+		run.Stages = append(run.Stages, s)
+	}
+	p.Runs = append(p.Runs, run)
+	p.mu.Unlock()
+
+	ws.AddEvent("Pipeline %s run %d started", name, run.Id)
+	go lenc.runPipeline(ws.Name, run, 0)
+	return run, nil
+}
+
+// StopPipeline stops the running run of the pipeline name, the tasks of its
+// running stage are stopped
+func (lenc *Lencak) StopPipeline(workSpaceName, name string) (*PipelineRun, error) {
+	_, p, err := lenc.pipeline(workSpaceName, name, "stop pipeline "+name)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	run := p.running()
+	p.mu.Unlock()
+	if run == nil {
+		return nil, fmt.Errorf("pipeline %s is not running", name)
+	}
+	run.mu.Lock()
+	if !run.stopped() {
+		close(run.stop)
+	}
+	run.mu.Unlock()
+	return run, nil
+}
+
+// RetryPipeline runs the failed or stopped run runID of the pipeline name again
+// from the stage that did not succeed, the stages before it are not run again
+func (lenc *Lencak) RetryPipeline(workSpaceName, name string, runID int) (*PipelineRun, error) {
+	ws, p, err := lenc.pipeline(workSpaceName, name, "retry pipeline "+name)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if runID < 0 || runID >= len(p.Runs) {
+		return nil, notFound("run %d of pipeline %s not found", runID, name)
+	}
+	if p.running() != nil {
+		return nil, &BusyError{Workspace: ws.Name, Operation: "pipeline " + name}
+	}
+	run := p.Runs[runID]
+
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	from := -1
+	for i, stage := range run.Stages {
+		if stage.Status != "ok" {
+			from = i
+			break
+		}
+	}
+	if from < 0 || run.Status == "succeeded" {
+		return nil, fmt.Errorf("run %d of pipeline %s did not fail", runID, name)
+	}
+	for _, stage := range run.Stages[from:] {
+		stage.Status = "pending"
+		for _, t := range stage.Tasks {
+			t.Status = "pending"
+			t.Runs = nil
+			t.Error = ""
+		}
+	}
+	run.Status = "running"
+	run.Finished = time.Time{}
+	run.stop = make(chan struct{})
+
+	ws.AddEvent("Pipeline %s run %d retried from stage %s", name, runID, run.Stages[from].Name)
+	go lenc.runPipeline(ws.Name, run, from)
+	return run, nil
+}
+
+// runPipeline runs the stages of the pipeline run from the stage at index from.
+// The run fails as soon as a stage fails, the stages left are skipped.
+func (lenc *Lencak) runPipeline(workSpaceName string, run *PipelineRun, from int) {
+	status := "succeeded"
+	for i := from; i < len(run.Stages); i++ {
+		result := "stopped"
+		if !run.stopped() {
+			result = lenc.runStage(workSpaceName, run, run.Stages[i])
+		}
+		if result != "ok" {
+			status = result
+			run.mu.Lock()
+			run.Stages[i].Status = result
+			for _, stage := range run.Stages[i+1:] {
+				stage.Status = "skipped"
+				for _, t := range stage.Tasks {
+					t.Status = "skipped"
+				}
+			}
+			run.mu.Unlock()
+			break
+		}
+	}
+
+	run.mu.Lock()
+	run.Status = status
+	run.Finished = time.Now()
+	run.mu.Unlock()
+	log.Infof("pipeline %s run %d of workspace %s %s", run.Pipeline, run.Id, workSpaceName, status)
+	if ws, err := lenc.workspace(workSpaceName); err == nil {
+		ws.AddEvent("Pipeline %s run %d %s", run.Pipeline, run.Id, status)
+	}
+	lenc.notify()
+}
+
+// runStage runs the tasks of the stage in parallel and waits until every task
+// is ready, see startAndWait. When a task fails, or the run is stopped, the
+// tasks of the stage still running are stopped. The status of the stage is
+// returned: ok, failed when a task failed, stopped when a task was stopped.
+func (lenc *Lencak) runStage(workSpaceName string, run *PipelineRun, stage *StageRun) string {
+	ws, err := lenc.workspace(workSpaceName)
+	if err != nil {
+		return "failed"
+	}
+	lenc.mu.RLock()
+	tasks := make([]*Task, len(stage.Tasks))
+	for i, t := range stage.Tasks {
+		tasks[i] = ws.Tasks[t.Task]
+	}
+	lenc.mu.RUnlock()
+
+	run.mu.Lock()
+	stage.Status = "running"
+	stage.Attempts++
+	run.mu.Unlock()
+	lenc.notify()
+
+	opts := &RunOptions{
+		correlation: run.correlation(),
+		triggeredBy: fmt.Sprintf("pipeline %s run %d, stage %s", run.Pipeline, run.Id, stage.Name),
+	}
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	var wg sync.WaitGroup
+	for i, task := range tasks {
+		if task == nil {
+			run.setTask(stage, i, "failed", nil, notFound("task %s not found", stage.Tasks[i].Task))
+			failOnce.Do(func() { close(failed) })
+			continue
+		}
+		wg.Add(1)
+		go func(i int, task *Task) {
+			defer wg.Done()
+			run.setTask(stage, i, "running", nil, nil)
+			lenc.notify()
+			runs, err := lenc.startAndWait(task, opts)
+			switch {
+			case err == nil:
+				run.setTask(stage, i, "ok", runs, nil)
+			case stoppedRuns(runs):
+				run.setTask(stage, i, "stopped", runs, err)
+			default:
+				run.setTask(stage, i, "failed", runs, err)
+				failOnce.Do(func() { close(failed) })
+			}
+			lenc.notify()
+		}(i, task)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-failed:
+		lenc.stopStage(run, stage, tasks)
+		<-done
+	case <-run.stop:
+		lenc.stopStage(run, stage, tasks)
+		<-done
+	}
+
+	status := "ok"
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	for _, t := range stage.Tasks {
+		switch {
+		case t.Status == "failed":
+			status = "failed"
+		case t.Status == "stopped" && status == "ok":
+			status = "stopped"
+		}
+	}
+	stage.Status = status
+	return status
+}
+
+// stopStage stops the tasks of the stage that are not ready yet
+func (lenc *Lencak) stopStage(run *PipelineRun, stage *StageRun, tasks []*Task) {
+	var wg sync.WaitGroup
+	for i, task := range tasks {
+		run.mu.Lock()
+		running := stage.Tasks[i].Status == "running"
+		run.mu.Unlock()
+		if task == nil || !running {
+			continue
+		}
+		wg.Add(1)
+		go func(task *Task) {
+			defer wg.Done()
+			task.Shutdown(stopTimeout)
+		}(task)
+	}
+	wg.Wait()
+}
+
+// stoppedRuns returns true when one of the runs was stopped by lencak
+func stoppedRuns(runs []*TaskRun) bool {
+	for _, run := range runs {
+		if run.isStopRequested() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,250 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// portAllocator reserves the ports of the tasks of every workspace, a port is
+// owned by one task at a time, identified as "workspace/task"
+type portAllocator struct {
+	mu     sync.Mutex
+	owners map[int]string
+}
+
+func newPortAllocator() *portAllocator {
+	return &portAllocator{owners: make(map[int]string)}
+}
+
+// reserve reserves ports for owner, none is reserved when another task owns one
+// of them
+func (a *portAllocator) reserve(owner string, ports []int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, port := range ports {
+		if other, ok := a.owners[port]; ok && other != owner {
+			return fmt.Errorf("port %d is already used by %s", port, other)
+		}
+	}
+	for _, port := range ports {
+		a.owners[port] = owner
+	}
+	return nil
+}
+
+// allocate reserves a free port for owner with the ports of its replicas, see
+// replicaPorts. A port is free when nothing listens on it and no other task
+// owns it. The port of the first replica is returned.
+func (a *portAllocator) allocate(owner string, replicas, offset int) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := 0; i < 100; i++ {
+		l, err := net.Listen("tcp", ":0")
+		if err != nil {
+			return 0, err
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+
+		ports := replicaPorts(port, replicas, offset)
+		free := true
+		for j, p := range ports {
+			if _, ok := a.owners[p]; ok || (j > 0 && !portFree(p)) {
+				free = false
+				break
+			}
+		}
+		if free {
+			for _, p := range ports {
+				a.owners[p] = owner
+			}
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free port found")
+}
+
+// replicaPorts returns port and the ports of the other replicas of a task with
+// a port offset, see ConfigTask.PortOffset
+func replicaPorts(port, replicas, offset int) []int {
+	ports := []int{port}
+	if offset == 0 {
+		return ports
+	}
+	for i := 1; i < replicas; i++ {
+		ports = append(ports, port+i*offset)
+	}
+	return ports
+}
+
+// portTable holds the ports published by the tasks of a workspace, it's shared
+// by the tasks of the workspace, see portVar
+type portTable struct {
+	mu   sync.Mutex
+	vars map[string]string
+}
+
+// get returns a copy of the published ports by variable
+func (p *portTable) get() map[string]string {
+	vars := make(map[string]string)
+	if p == nil {
+		return vars
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, v := range p.vars {
+		vars[k] = v
+	}
+	return vars
+}
+
+func (p *portTable) set(name, value string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.vars[name] = value
+}
+
+// release releases the ports owned by the tasks of the workspace, except the
+// ports of keep
+func (a *portAllocator) release(workspace string, keep map[int]bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for port, owner := range a.owners {
+		if strings.HasPrefix(owner, workspace+"/") && !keep[port] {
+			delete(a.owners, port)
+		}
+	}
+}
+
+var nonVarRe = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// portVar returns the variable publishing the port variable name of the task
+// to the other tasks of the workspace, e.g API_PORT for the variable PORT of
+// the task api
+func portVar(task, name string) string {
+	return strings.ToUpper(nonVarRe.ReplaceAllString(task, "_")) + "_" + name
+}
+
+// assignPorts gives every task of the workspace the ports it declares: pinned
+// ports are reserved and the others are allocated, unless the task replaces a
+// task of previous that already had one. The ports of the replicas of a task
+// with a port offset are reserved too. The ports of every task are then
+// published to the other tasks of the workspace, see portVar. A port used by
+// another task is recorded as an event of the workspace. An allocated port is
+// checked again when the task starts, see checkPorts.
+func (lenc *Lencak) assignPorts(ws *Workspace, previous map[string]*Task) {
+	keep := make(map[int]bool)
+	published := &portTable{vars: make(map[string]string)}
+	for _, tn := range sortedKeys(ws.Tasks) {
+		t := ws.Tasks[tn]
+		owner := ws.Name + "/" + tn
+		replicas, offset := t.Config.replicas(), t.Config.PortOffset
+		ports := make(map[string]int)
+		for _, name := range sortedKeys(t.Config.Ports) {
+			port := t.Config.Ports[name]
+			if old, ok := previous[tn]; ok && port == 0 {
+				port = old.allocatedPort(name)
+			}
+
+			var err error
+			if port != 0 {
+				err = lenc.ports.reserve(owner, replicaPorts(port, replicas, offset))
+			} else {
+				port, err = lenc.ports.allocate(owner, replicas, offset)
+			}
+			if err != nil {
+				ws.AddEvent("Task %s: unable to assign $%s: %v", tn, name, err)
+				continue
+			}
+			ports[name] = port
+			for _, p := range replicaPorts(port, replicas, offset) {
+				keep[p] = true
+			}
+			published.vars[portVar(tn, name)] = strconv.Itoa(port)
+		}
+
+		t.activeMu.Lock()
+		t.Ports = ports
+		t.allocator = lenc.ports
+		t.portOwner = owner
+		t.activeMu.Unlock()
+	}
+	lenc.ports.release(ws.Name, keep)
+
+	for _, t := range ws.Tasks {
+		t.activeMu.Lock()
+		t.published = published
+		t.activeMu.Unlock()
+	}
+}
+
+// checkPorts checks the allocated ports of the task before its instance starts:
+// a port taken by another process since it was allocated is replaced by a new
+// port, published again. The ports of an instance offset from the ports of the
+// task are reserved. A message is returned for every port replaced. activeMu
+// must be held.
+func (t *Task) checkPorts(instance int) ([]string, error) {
+	if t.allocator == nil {
+		return nil, nil
+	}
+	var moved []string
+	offset := t.Config.PortOffset
+	// the ports of running instances or of the sockets are used by the task
+	idle := t.running() == 0
+	bound := t.boundPorts()
+	ports := make(map[string]int)
+	for _, name := range sortedKeys(t.Ports) {
+		port := t.Ports[name]
+		if t.Config.Ports[name] == 0 && idle && !bound[port] && !portFree(port) {
+			allocated, err := t.allocator.allocate(t.portOwner, len(t.instances), offset)
+			if err != nil {
+				return nil, fmt.Errorf("unable to assign $%s: %v", name, err)
+			}
+			moved = append(moved, fmt.Sprintf("Port %d of $%s is in use, $%s is now %d", port, name, name, allocated))
+			port = allocated
+			t.published.set(portVar(t.Name, name), strconv.Itoa(port))
+		}
+		if offset != 0 && instance > 0 {
+			if err := t.allocator.reserve(t.portOwner, []int{port + instance*offset}); err != nil {
+				return nil, fmt.Errorf("unable to assign $%s to instance %d: %v", name, instance, err)
+			}
+		}
+		ports[name] = port
+	}
+	// the map is replaced, it's read without activeMu once copied
+	t.Ports = ports
+	return moved, nil
+}
+
+// allocatedPort returns the port assigned to the port variable name of the task,
+// 0 when it has none
+func (t *Task) allocatedPort(name string) int {
+	t.activeMu.Lock()
+	defer t.activeMu.Unlock()
+	return t.Ports[name]
+}
+
+// portsInUse returns an error when one of ports, by variable name, is used by
+// another process
+func portsInUse(ports map[string]int) error {
+	for _, name := range sortedKeys(ports) {
+		if !portFree(ports[name]) {
+			return fmt.Errorf("port %d of $%s is already in use", ports[name], name)
+		}
+	}
+	return nil
+}
+
+// portFree returns true when nothing listens on the tcp port
+func portFree(port int) bool {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
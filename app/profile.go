@@ -0,0 +1,186 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Profile is a named subset of the tasks of a workspace, the tasks of the active
+// profile are started with the workspace and the environment of the profile is
+// overlaid on the environment of every task
+type Profile struct {
+	Name        string            `json:"name"`
+	Tasks       []string          `json:"tasks"`
+	Environment map[string]string `json:"environment,omitempty"`
+}
+
+// autoStarted returns the names of the tasks starting with the workspace: when a
+// profile is active the tasks of the profile and the tasks they depend on,
+// otherwise the services that are not started on demand
+func (ws *Workspace) autoStarted() map[string]bool {
+	names := make(map[string]bool)
+	p, ok := ws.Profiles[ws.Profile]
+	if !ok {
+		for name, t := range ws.Tasks {
+			if t.Config.Service && !t.Config.OnDemand {
+				names[name] = true
+			}
+		}
+		return names
+	}
+
+	var add func(name string)
+	add = func(name string) {
+		t, ok := ws.Tasks[name]
+		if !ok || names[name] {
+			return
+		}
+		names[name] = true
+		for _, dep := range t.DependsOn {
+			add(dep)
+		}
+	}
+	for _, name := range p.Tasks {
+		add(name)
+	}
+	return names
+}
+
+// autoStart starts the tasks starting with the workspace in dependency order
+func (lenc *Lencak) autoStart(ws *Workspace) {
+	lenc.mu.RLock()
+	var names []string
+	for name := range ws.autoStarted() {
+		names = append(names, name)
+	}
+	levels, err := dependencyLevels(ws.Tasks, names, false)
+	lenc.mu.RUnlock()
+	if len(names) == 0 {
+		return
+	}
+	if err != nil {
+		ws.AddEvent("Unable to start the workspace: %v", err)
+		return
+	}
+	operation := "start workspace"
+	if ws.Profile != "" {
+		operation = "start profile " + ws.Profile
+	}
+	if _, err := lenc.runOperation(ws, operation, nil, levels); err != nil {
+		ws.AddEvent("Unable to start the workspace: %v", err)
+	}
+}
+
+// SelectProfiles selects the profile active when the workspaces start. A profile
+// is given as "workspace/profile", or as "profile" to select it in every
+// workspace declaring it. An error is returned when a profile is not declared.
+func SelectProfiles(config map[string]*ConfigWorkspace, profiles []string) error {
+	for _, selected := range profiles {
+		name := selected
+		workspace := ""
+		if i := strings.Index(selected, "/"); i >= 0 {
+			workspace, name = selected[:i], selected[i+1:]
+		}
+
+		found := false
+		for wsName, cfg := range config {
+			if workspace != "" && wsName != workspace {
+				continue
+			}
+			if _, ok := cfg.Profiles[name]; ok {
+				cfg.profile = name
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("profile %s not found", selected)
+		}
+	}
+	return nil
+}
+
+// SwitchProfile makes profile the active profile of the workspace, an empty
+// profile deactivates the active one. Only the difference is applied, see
+// autoStarted: the tasks started with the previous profile that are not part of
+// the new one are stopped, the tasks of the new profile that were not part of
+// the previous one are started and the running tasks whose environment changed
+// with the overlay of the profile are restarted.
+func (lenc *Lencak) SwitchProfile(workSpaceName, profile string) (*OperationResult, error) {
+	action := "switch to profile " + profile
+	if profile == "" {
+		action = "deactivate profile"
+	}
+	ws, err := lenc.unlockedWorkspace(workSpaceName, action)
+	if err != nil {
+		return nil, err
+	}
+	// the workspace is reserved before its tasks are replaced
+	result, err := lenc.beginOperation(ws, action)
+	if err != nil {
+		return nil, err
+	}
+
+	lenc.mu.Lock()
+	if _, ok := ws.Profiles[profile]; profile != "" && !ok {
+		lenc.mu.Unlock()
+		lenc.cancelOperation(ws, result)
+		return nil, notFound("profile %s not found in workspace %s", profile, workSpaceName)
+	}
+
+	fresh := newWorkspaceFromConfig(lenc.sync, ws.config, profile)
+	before := ws.autoStarted()
+	after := fresh.autoStarted()
+
+	next := make(map[string]*Task)
+	var stop, start, changed []string
+	for name, t := range ws.Tasks {
+		next[name] = t
+		running := t.Running()
+		leaving := before[name] && !after[name]
+		joining := after[name] && !before[name]
+		if t.definitionChanged(fresh.Tasks[name]) {
+			changed = append(changed, name)
+			next[name] = fresh.Tasks[name]
+		}
+		replaced := next[name] != t
+
+		if leaving || (replaced && running) {
+			stop = append(stop, name)
+		}
+		if joining || (replaced && running && !leaving) {
+			start = append(start, name)
+		}
+	}
+
+	stopLevels, err := dependencyLevels(ws.Tasks, stop, false)
+	if err != nil {
+		lenc.mu.Unlock()
+		lenc.cancelOperation(ws, result)
+		return nil, err
+	}
+	startLevels, err := dependencyLevels(next, start, false)
+	if err != nil {
+		lenc.mu.Unlock()
+		lenc.cancelOperation(ws, result)
+		return nil, err
+	}
+
+	for _, name := range changed {
+		t := ws.Tasks[name]
+		next[name].inheritRuns(t)
+		next[name].inheritSockets(t)
+		// the sockets not inherited are declared differently by the new task
+		t.closeSockets()
+		t.unwatch()
+	}
+	previous := ws.Tasks
+	ws.Tasks = next
+	ws.Profile = fresh.Profile
+	lenc.assignPorts(ws, previous)
+	lenc.watchTasks(ws)
+	lenc.chainTasks(ws)
+	lenc.mu.Unlock()
+
+	lenc.continueOperation(ws, result, stopLevels, startLevels)
+	return result, nil
+}
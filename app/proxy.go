@@ -0,0 +1,179 @@
+package app
+
+import (
+	"html/template"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// proxyHost returns the workspace and the task a host routes to, the host of a
+// task is <task>.<workspace>.localhost, e.g api.shop.localhost:9056
+func proxyHost(host string) (workspace, task string, ok bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	labels := strings.Split(strings.ToLower(host), ".")
+	if len(labels) != 3 || labels[2] != "localhost" || labels[0] == "" || labels[1] == "" {
+		return "", "", false
+	}
+	return labels[1], labels[0], true
+}
+
+// proxyPortVar returns the port variable of the task the proxy routes to: $PORT
+// when the task has one, otherwise the first port of the task
+func (t *Task) proxyPortVar() string {
+	t.activeMu.Lock()
+	defer t.activeMu.Unlock()
+	if _, ok := t.Ports["PORT"]; ok {
+		return "PORT"
+	}
+	if _, ok := t.Environment["PORT"]; ok {
+		return "PORT"
+	}
+	if ports := sortedKeys(t.Ports); len(ports) > 0 {
+		return ports[0]
+	}
+	return ""
+}
+
+// upstreams returns the addresses of the running instances of the task taskName
+func (lenc *Lencak) upstreams(workSpaceName, taskName string) (*Task, []string, error) {
+	ws, err := lenc.workspace(workSpaceName)
+	if err != nil {
+		return nil, nil, err
+	}
+	lenc.mu.RLock()
+	task := ws.Tasks[taskName]
+	lenc.mu.RUnlock()
+	if task == nil {
+		return nil, nil, notFound("task %s not found in workspace %s", taskName, workSpaceName)
+	}
+
+	name := task.proxyPortVar()
+	if name == "" {
+		return task, nil, notFound("task %s of workspace %s has no port", taskName, workSpaceName)
+	}
+	var addrs []string
+	for _, run := range task.activeRuns() {
+		if port := run.Environment[name]; port != "" {
+			addrs = append(addrs, net.JoinHostPort("127.0.0.1", port))
+		}
+	}
+	return task, addrs, nil
+}
+
+var proxyErrorTemplate = template.Must(template.New("proxy").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>{{.Task}} is unavailable</title>
+<meta http-equiv="refresh" content="5">
+<style>body { font-family: sans-serif; margin: 40px; color: #333 } code { background: #eee; padding: 2px 4px }</style>
+</head>
+<body>
+<h1>{{.Task}} is unavailable</h1>
+<p>lencak could not reach the task <code>{{.Task}}</code> of the workspace <code>{{.Workspace}}</code>.</p>
+<p>{{.Reason}}</p>
+{{if .Status}}<p>Status of the task: <code>{{.Status}}</code></p>{{end}}
+<p>This page reloads every 5 seconds.</p>
+</body>
+</html>
+`))
+
+// proxyError responds with a page explaining why the request could not be proxied
+// to the task
+func proxyError(w http.ResponseWriter, status int, workspace, task string, t *Task, reason string) {
+	data := map[string]string{
+		"Workspace": workspace,
+		"Task":      task,
+		"Reason":    reason,
+	}
+	if t != nil {
+		data["Status"] = t.Status()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := proxyErrorTemplate.Execute(w, data); err != nil {
+		log.Errorf("[proxy] error executing template: %v", err)
+	}
+}
+
+// proxyHandler proxies requests, websockets included, to the http port of a task,
+// see proxyPortVar. A task is reached at /proxy/<workspace>/<task>/ or through
+// its host, see proxyHost. The requests are balanced between the running
+// instances of the task, an on-demand task is started by the first request.
+func (app *App) proxyHandler() http.HandlerFunc {
+	var mu sync.Mutex
+	next := make(map[string]int)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		workspace, task, ok := proxyHost(r.Host)
+		prefix := ""
+		if !ok {
+			vars := mux.Vars(r)
+			workspace, task = vars["workspace"], vars["task"]
+			prefix = "/proxy/" + workspace + "/" + task
+		}
+
+		t, upstreams, err := app.lencak.upstreams(workspace, task)
+		if err != nil {
+			proxyError(w, http.StatusNotFound, workspace, task, t, err.Error())
+			return
+		}
+		if t.Config.OnDemand {
+			// the task in use isn't stopped for being idle, the upstreams are
+			// resolved again once a stop in progress is over
+			defer t.connected()()
+			_, upstreams, _ = app.lencak.upstreams(workspace, task)
+		}
+		if len(upstreams) == 0 && t.Config.OnDemand {
+			if err := app.lencak.activate(workspace, task); err != nil {
+				proxyError(w, http.StatusBadGateway, workspace, task, t, "The task could not be started on demand: "+err.Error())
+				return
+			}
+			_, upstreams, _ = app.lencak.upstreams(workspace, task)
+		}
+		if len(upstreams) == 0 {
+			proxyError(w, http.StatusBadGateway, workspace, task, t, "The task is not running.")
+			return
+		}
+
+		mu.Lock()
+		key := workspace + "/" + task
+		target := upstreams[next[key]%len(upstreams)]
+		next[key]++
+		mu.Unlock()
+
+		proxy := &httputil.ReverseProxy{
+			Director: func(req *http.Request) {
+				req.URL.Scheme = "http"
+				req.URL.Host = target
+				req.URL.Path = strings.TrimPrefix(req.URL.Path, prefix)
+				req.URL.RawPath = ""
+				if req.URL.Path == "" {
+					req.URL.Path = "/"
+				}
+				req.Header.Set("X-Forwarded-Host", r.Host)
+				if prefix != "" {
+					req.Header.Set("X-Forwarded-Prefix", prefix)
+				}
+			},
+			ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+				log.Warnf("[proxy] %s: %v", key, err)
+				proxyError(w, http.StatusBadGateway, workspace, task, t, "The task does not respond: "+err.Error())
+			},
+			FlushInterval: -1,
+		}
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+// proxyRedirect redirects /proxy/<workspace>/<task> to the root of the task
+func proxyRedirect(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+}
@@ -0,0 +1,225 @@
+package app
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stopTimeout is the time given to a task to exit before it gets killed when
+// lencak waits for it to stop, e.g a removed or changed task during a reload
+const stopTimeout = 10 * time.Second
+
+// ReloadReport describes the changes applied to the running workspaces by a
+// configuration reload. Tasks are identified as "workspace/task".
+type ReloadReport struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Restarted []string `json:"restarted"`
+	Unchanged []string `json:"unchanged"`
+	// the locked workspaces, left untouched by the reload
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+func (r *ReloadReport) String() string {
+	s := fmt.Sprintf("%d added, %d removed, %d restarted, %d unchanged",
+		len(r.Added), len(r.Removed), len(r.Restarted), len(r.Unchanged))
+	if len(r.Skipped) > 0 {
+		s += fmt.Sprintf(", %d locked workspaces skipped", len(r.Skipped))
+	}
+	return s
+}
+
+// Reload applies config to the running workspaces. New tasks are added,
+// tasks that no longer exist are stopped and removed, tasks whose command,
+// environment, working directory or executor changed are restarted, tasks whose
+// replicas changed are scaled and every other task is left untouched. A locked
+// workspace is left as it is, the configuration of its files is applied by the
+// next reload once it's unlocked.
+func (lenc *Lencak) Reload(config map[string]*ConfigWorkspace) *ReloadReport {
+	report := &ReloadReport{}
+	var stop, start, scale []*Task
+
+	lenc.mu.Lock()
+	locked := make(map[string]bool)
+	for name, ws := range lenc.workspaces {
+		if lock := ws.CurrentLock(); lock != nil {
+			ws.AddEvent("Refused to reload the configuration: %s", lock)
+			report.Skipped = append(report.Skipped, name)
+			locked[name] = true
+		}
+	}
+	for name, ws := range lenc.workspaces {
+		if _, ok := config[name]; ok || locked[name] {
+			continue
+		}
+		log.Infof("=> Removing workspace: %s", name)
+		for tn, t := range ws.Tasks {
+			report.Removed = append(report.Removed, name+"/"+tn)
+			stop = append(stop, t)
+			t.unwatch()
+		}
+		delete(lenc.workspaces, name)
+		lenc.ports.release(name, nil)
+	}
+
+	for name, cfg := range config {
+		if locked[name] {
+			continue
+		}
+		current, ok := lenc.workspaces[name]
+		// a profile switched to at runtime stays active
+		profile := cfg.profile
+		if ok {
+			profile = current.Profile
+		}
+		fresh := newWorkspaceFromConfig(lenc.sync, cfg, profile)
+		autoStarted := fresh.autoStarted()
+		if !ok {
+			log.Infof("=> Adding workspace: %s", name)
+			for tn, t := range fresh.Tasks {
+				report.Added = append(report.Added, name+"/"+tn)
+				if autoStarted[tn] {
+					start = append(start, t)
+				}
+			}
+			lenc.workspaces[name] = fresh
+			lenc.assignPorts(fresh, nil)
+			lenc.watchTasks(fresh)
+			lenc.chainTasks(fresh)
+			fresh.AddEvent("Workspace added by configuration reload")
+			continue
+		}
+
+		previous := make(map[string]*Task)
+		for tn, t := range current.Tasks {
+			previous[tn] = t
+		}
+		var added, removed, restarted int
+		for tn, t := range current.Tasks {
+			if _, ok := fresh.Tasks[tn]; !ok {
+				report.Removed = append(report.Removed, name+"/"+tn)
+				stop = append(stop, t)
+				t.unwatch()
+				delete(current.Tasks, tn)
+				removed++
+			}
+		}
+		for tn, t := range fresh.Tasks {
+			old, ok := current.Tasks[tn]
+			switch {
+			case !ok:
+				report.Added = append(report.Added, name+"/"+tn)
+				current.Tasks[tn] = t
+				if autoStarted[tn] {
+					start = append(start, t)
+				}
+				added++
+
+			case old.definitionChanged(t):
+				report.Restarted = append(report.Restarted, name+"/"+tn)
+				if autoStarted[tn] || old.Running() {
+					start = append(start, t)
+				}
+				stop = append(stop, old)
+				old.unwatch()
+				t.inheritRuns(old)
+				t.inheritSockets(old)
+				current.Tasks[tn] = t
+				restarted++
+
+			default:
+				report.Unchanged = append(report.Unchanged, name+"/"+tn)
+				if old.Config.replicas() != t.Config.replicas() {
+					scale = append(scale, old)
+				}
+				if !reflect.DeepEqual(old.Config.Watch, t.Config.Watch) {
+					// watched again with the new configuration below
+					old.unwatch()
+				}
+				if old.update(t) {
+					start = append(start, old)
+				}
+			}
+		}
+
+		// keep the runs of the functions still declared
+		for fn, function := range fresh.Functions {
+			if old, ok := current.Functions[fn]; ok {
+				old.update(function)
+				fresh.Functions[fn] = old
+			}
+		}
+
+		// keep the runs of the pipelines still declared
+		for pn, pipeline := range fresh.Pipelines {
+			if old, ok := current.Pipelines[pn]; ok {
+				old.update(pipeline)
+				fresh.Pipelines[pn] = old
+			}
+		}
+
+		current.Environment = fresh.Environment
+		current.Functions = fresh.Functions
+		current.Pipelines = fresh.Pipelines
+		current.Columns = fresh.Columns
+		current.InheritEnvironment = fresh.InheritEnvironment
+		current.Profiles = fresh.Profiles
+		current.Profile = fresh.Profile
+		current.config = cfg
+		lenc.assignPorts(current, previous)
+		lenc.watchTasks(current)
+		lenc.chainTasks(current)
+		current.AddEvent("Configuration reloaded: %d added, %d removed, %d restarted",
+			added, removed, restarted)
+	}
+	lenc.mu.Unlock()
+
+	for _, t := range stop {
+		t.Shutdown(stopTimeout)
+		t.closeSockets()
+	}
+	for _, t := range start {
+		if _, err := t.Start(lenc.sync); err != nil {
+			log.Warnf("task %s not started after the reload: %v", t.Name, err)
+		}
+	}
+	for _, t := range scale {
+		t.Scale(lenc.sync, t.Config.replicas())
+	}
+
+	sort.Strings(report.Added)
+	sort.Strings(report.Removed)
+	sort.Strings(report.Restarted)
+	sort.Strings(report.Unchanged)
+	sort.Strings(report.Skipped)
+	log.Infof("Configuration reloaded: %s", report)
+	lenc.notify()
+
+	return report
+}
+
+// update copies the attributes of other that can change without restarting the
+// task. It returns true when the task became a service and should be started.
+func (t *Task) update(other *Task) bool {
+	t.KillSignal = other.KillSignal
+	t.Stdout = other.Stdout
+	t.Stderr = other.Stderr
+	t.DependsOn = other.DependsOn
+	t.Labels = other.Labels
+	t.Metadata = other.Metadata
+
+	previous := t.Config
+	t.Config = other.Config
+
+	t.serviceMu.Lock()
+	defer t.serviceMu.Unlock()
+	if previous.Service == other.Config.Service {
+		return false
+	}
+	t.Service = other.Config.Service
+	return t.Service && !t.Running()
+}
@@ -0,0 +1,145 @@
+package app
+
+import "time"
+
+const (
+	// defaultRetryBackoff is the delay before the first retry of a failed run
+	// when the task doesn't set one
+	defaultRetryBackoff = time.Second
+
+	// maxRetryBackoff caps the delay before a retry, unless the task sets a
+	// longer backoff
+	maxRetryBackoff = 5 * time.Minute
+)
+
+// shouldRetry returns true when the run exiting with status has attempts left
+// and status is retried, a run stopped by lencak is not. It's called with
+// retryMu held.
+func (tr *TaskRun) shouldRetry(status int) bool {
+	if tr.Attempt == 0 || status == 0 || tr.stopRequested {
+		return false
+	}
+	if tr.retries <= 0 {
+		tr.addEvent("Failed after %d attempts", tr.Attempt)
+		return false
+	}
+	if len(tr.retryOn) == 0 {
+		return true
+	}
+	for _, code := range tr.retryOn {
+		if code == status {
+			return true
+		}
+	}
+	tr.addEvent("Exit status %d is not retried", status)
+	return false
+}
+
+// retryOf makes the run the attempt following prev in the execution of prev
+func (tr *TaskRun) retryOf(prev *TaskRun) {
+	first := prev.Id
+	if prev.RetryOf != nil {
+		first = *prev.RetryOf
+	}
+	tr.RetryOf = &first
+	tr.Attempt = prev.Attempt + 1
+	tr.retries = prev.retries - 1
+	tr.retryOn = prev.retryOn
+	tr.retryBackoff = prev.retryBackoff
+	tr.addEvent("Attempt %d of run %d", tr.Attempt, first)
+}
+
+// retryDelay returns the delay before the attempt following the run, the backoff
+// doubles with every attempt up to maxRetryBackoff
+func (tr *TaskRun) retryDelay() time.Duration {
+	limit := maxRetryBackoff
+	if tr.retryBackoff > limit {
+		limit = tr.retryBackoff
+	}
+	delay := tr.retryBackoff
+	for i := 1; i < tr.Attempt && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	return delay
+}
+
+// isRetrying returns true while the failed run waits for its retry
+func (tr *TaskRun) isRetrying() bool {
+	tr.retryMu.Lock()
+	defer tr.retryMu.Unlock()
+	return tr.retrying
+}
+
+// isStopRequested returns true when lencak stopped the run
+func (tr *TaskRun) isStopRequested() bool {
+	tr.retryMu.Lock()
+	defer tr.retryMu.Unlock()
+	return tr.stopRequested
+}
+
+// abandonRetry records why the failed run is not retried after all, the run is
+// then the last attempt and triggers the tasks
+func (tr *TaskRun) abandonRetry(format string, args ...interface{}) {
+	tr.addEvent(format, args...)
+	tr.retryMu.Lock()
+	tr.retrying = false
+	tr.retryMu.Unlock()
+	if tr.exited != nil {
+		go tr.exited(tr)
+	}
+}
+
+// WaitAttempts blocks until the process of the run and of its retries exited,
+// the last attempt is returned
+func (tr *TaskRun) WaitAttempts() *TaskRun {
+	run := tr
+	for {
+		run.Wait()
+		if !run.isRetrying() {
+			return run
+		}
+		<-run.retried
+		if run.next == nil {
+			return run
+		}
+		run = run.next
+	}
+}
+
+// retry starts the attempt following the failed run in its instance once the
+// backoff of the run elapsed, unless the instance was stopped meanwhile. The
+// attempt is created by newRun. It's returned with the channel the exit status
+// of the last attempt is sent on, nil when the run is not retried.
+func (t *Task) retry(sync chan bool, instance int, run *TaskRun, newRun func(instance int) *TaskRun) (*TaskRun, chan int) {
+	defer close(run.retried)
+
+	delay := run.retryDelay()
+	run.addEvent("Attempt %d failed with status %d, retrying in %s", run.Attempt, run.WaitStatus.ExitStatus(), delay)
+	select {
+	case sync <- true:
+	default:
+	}
+	time.Sleep(delay)
+
+	// the instance keeps the failed run until the retry, stopping the task
+	// abandons it
+	t.activeMu.Lock()
+	if instance >= len(t.instances) || t.instances[instance] != run {
+		t.activeMu.Unlock()
+		run.abandonRetry("Retry abandoned, task %s was stopped", t.Name)
+		return nil, nil
+	}
+	t.instances[instance] = nil
+	t.activeMu.Unlock()
+
+	next, c := t.startAttempt(sync, instance, newRun, run)
+	if next == nil {
+		run.abandonRetry("Retry abandoned, instance %d of task %s is running", instance, t.Name)
+		return nil, nil
+	}
+	run.next = next
+	return next, c
+}
@@ -0,0 +1,26 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		backoff time.Duration
+		attempt int
+		want    time.Duration
+	}{
+		{backoff: time.Second, attempt: 1, want: time.Second},
+		{backoff: time.Second, attempt: 4, want: 8 * time.Second},
+		{backoff: time.Second, attempt: 10, want: maxRetryBackoff},
+		{backoff: time.Second, attempt: 100, want: maxRetryBackoff},
+		{backoff: 10 * time.Minute, attempt: 3, want: 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		tr := &TaskRun{retryBackoff: tt.backoff, Attempt: tt.attempt}
+		if got := tr.retryDelay(); got != tt.want {
+			t.Errorf("retryDelay(%s, attempt %d) = %s, want %s", tt.backoff, tt.attempt, got, tt.want)
+		}
+	}
+}
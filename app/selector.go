@@ -0,0 +1,162 @@
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var labelKeyRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_./-]*[A-Za-z0-9])?$`)
+
+// Requirement is a condition on one label of a task
+type Requirement struct {
+	Key string
+	// =, != or exists, a ! before the key means the label must not exist
+	Operator string
+	Value    string
+}
+
+// Selector selects tasks by their labels, a task matches when it matches every
+// requirement of the selector
+type Selector []Requirement
+
+// ParseSelector parses a comma separated list of requirements: "key=value",
+// "key!=value", "key" for a label that exists and "!key" for one that doesn't,
+// e.g "tier=backend,team!=infra"
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var r Requirement
+		switch {
+		case strings.Contains(term, "!="):
+			p := strings.SplitN(term, "!=", 2)
+			r = Requirement{Key: strings.TrimSpace(p[0]), Operator: "!=", Value: strings.TrimSpace(p[1])}
+		case strings.Contains(term, "="):
+			p := strings.SplitN(term, "=", 2)
+			r = Requirement{Key: strings.TrimSpace(p[0]), Operator: "=", Value: strings.TrimSpace(p[1])}
+		case strings.HasPrefix(term, "!"):
+			r = Requirement{Key: strings.TrimSpace(term[1:]), Operator: "!"}
+		default:
+			r = Requirement{Key: term, Operator: "exists"}
+		}
+		if !labelKeyRe.MatchString(r.Key) {
+			return nil, fmt.Errorf("invalid label selector %q: invalid label %q", s, r.Key)
+		}
+		sel = append(sel, r)
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("empty label selector")
+	}
+	return sel, nil
+}
+
+// Matches returns true when labels satisfy every requirement of the selector
+func (sel Selector) Matches(labels map[string]string) bool {
+	for _, r := range sel {
+		value, ok := labels[r.Key]
+		switch r.Operator {
+		case "=":
+			if !ok || value != r.Value {
+				return false
+			}
+		case "!=":
+			if ok && value == r.Value {
+				return false
+			}
+		case "!":
+			if ok {
+				return false
+			}
+		default:
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (sel Selector) String() string {
+	terms := make([]string, len(sel))
+	for i, r := range sel {
+		switch r.Operator {
+		case "exists":
+			terms[i] = r.Key
+		case "!":
+			terms[i] = "!" + r.Key
+		default:
+			terms[i] = r.Key + r.Operator + r.Value
+		}
+	}
+	return strings.Join(terms, ",")
+}
+
+// SelectTasks returns the sorted names of the tasks of the workspace whose labels
+// match sel
+func (ws *Workspace) SelectTasks(sel Selector) []string {
+	var names []string
+	for name, t := range ws.Tasks {
+		if sel.Matches(t.Labels) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FindTasks returns the tasks matching sel by workspace, in every workspace when
+// workSpaceName is empty
+func (lenc *Lencak) FindTasks(workSpaceName string, sel Selector) (map[string]map[string]*Task, error) {
+	lenc.mu.RLock()
+	defer lenc.mu.RUnlock()
+
+	found := make(map[string]map[string]*Task)
+	for name, ws := range lenc.workspaces {
+		if workSpaceName != "" && name != workSpaceName {
+			continue
+		}
+		tasks := make(map[string]*Task)
+		for _, tn := range ws.SelectTasks(sel) {
+			tasks[tn] = ws.Tasks[tn]
+		}
+		found[name] = tasks
+	}
+	if workSpaceName != "" && len(found) == 0 {
+		return nil, notFound("workspace %s not found", workSpaceName)
+	}
+	return found, nil
+}
+
+// StartSelected starts the tasks of the workspace matching sel and the tasks
+// they depend on, see startTasks
+func (lenc *Lencak) StartSelected(workSpaceName string, sel Selector) (*OperationResult, error) {
+	ws, levels, err := lenc.selectedLevels(workSpaceName, sel, "start", true)
+	if err != nil {
+		return nil, err
+	}
+	return lenc.runOperation(ws, "start "+sel.String(), nil, levels)
+}
+
+// StopSelected stops the tasks of the workspace matching sel, see stopTasks
+func (lenc *Lencak) StopSelected(workSpaceName string, sel Selector) (*OperationResult, error) {
+	ws, levels, err := lenc.selectedLevels(workSpaceName, sel, "stop", false)
+	if err != nil {
+		return nil, err
+	}
+	return lenc.runOperation(ws, "stop "+sel.String(), levels, nil)
+}
+
+func (lenc *Lencak) selectedLevels(workSpaceName string, sel Selector, action string, withDeps bool) (*Workspace, [][]*Task, error) {
+	return lenc.operationLevels(workSpaceName, action+" "+sel.String(), withDeps, func(ws *Workspace) ([]string, error) {
+		names := ws.SelectTasks(sel)
+		if len(names) == 0 {
+			return nil, notFound("no task of workspace %s matches %s", workSpaceName, sel)
+		}
+		return names, nil
+	})
+}
@@ -0,0 +1,34 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// signals are the signals that can be sent to a run, by name
+var signals = map[string]syscall.Signal{
+	"sighup":  syscall.SIGHUP,
+	"sigint":  syscall.SIGINT,
+	"sigquit": syscall.SIGQUIT,
+	"sigterm": syscall.SIGTERM,
+	"sigkill": syscall.SIGKILL,
+	"sigusr1": syscall.SIGUSR1,
+	"sigusr2": syscall.SIGUSR2,
+}
+
+// Signal sends the signal named name, e.g sighup, to the process of the run
+func (tr *TaskRun) Signal(name string) error {
+	sig, ok := signals[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown signal %s", name)
+	}
+	if tr.Cmd == nil || tr.Cmd.Process == nil {
+		return fmt.Errorf("process not started")
+	}
+	if err := tr.Cmd.Process.Signal(sig); err != nil {
+		return err
+	}
+	tr.addEvent("Signal %s sent to process %d", strings.ToLower(name), tr.Cmd.Process.Pid)
+	return nil
+}
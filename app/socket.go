@@ -0,0 +1,174 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var socketNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// listenScript sets LISTEN_PID to the pid of the process it executes, the pid
+// of the shell is kept by exec
+const listenScript = `LISTEN_PID=$$; export LISTEN_PID; exec "$0" "$@"`
+
+// socket is a socket lencak listens on for a task, it outlives the runs of the
+// task so that no connection is refused while the task restarts
+type socket struct {
+	name     string
+	listener net.Listener
+	file     *os.File
+}
+
+// listen opens the socket named name on address, "unix:<path>" for a unix
+// socket, a tcp address otherwise
+func listen(name, address string) (*socket, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+		os.Remove(address)
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("socket %s: %v", name, err)
+	}
+
+	var f *os.File
+	switch l := l.(type) {
+	case *net.TCPListener:
+		f, err = l.File()
+	case *net.UnixListener:
+		f, err = l.File()
+	}
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("socket %s: %v", name, err)
+	}
+	return &socket{name: name, listener: l, file: f}, nil
+}
+
+func (s *socket) close() {
+	s.file.Close()
+	s.listener.Close()
+}
+
+// openSockets opens the sockets of the task unless they are open, in the order
+// of their names. activeMu must be held.
+func (t *Task) openSockets() ([]*socket, error) {
+	if len(t.sockets) > 0 || len(t.Config.Sockets) == 0 {
+		return t.sockets, nil
+	}
+
+	vars := make(map[string]string)
+	for k, v := range t.Environment {
+		vars[k] = v
+	}
+	for name, port := range t.Ports {
+		vars[name] = strconv.Itoa(port)
+	}
+	var sockets []*socket
+	for _, name := range sortedKeys(t.Config.Sockets) {
+		s, err := listen(name, ReplaceVars(t.Config.Sockets[name], vars))
+		if err != nil {
+			for _, s := range sockets {
+				s.close()
+			}
+			return nil, err
+		}
+		sockets = append(sockets, s)
+	}
+	t.sockets = sockets
+	return sockets, nil
+}
+
+// boundPorts returns the tcp ports of the sockets of the task, activeMu must be
+// held
+func (t *Task) boundPorts() map[int]bool {
+	ports := make(map[int]bool)
+	for _, s := range t.sockets {
+		if addr, ok := s.listener.Addr().(*net.TCPAddr); ok {
+			ports[addr.Port] = true
+		}
+	}
+	return ports
+}
+
+// closeSockets closes the sockets of the task
+func (t *Task) closeSockets() {
+	t.activeMu.Lock()
+	defer t.activeMu.Unlock()
+	for _, s := range t.sockets {
+		s.close()
+	}
+	t.sockets = nil
+}
+
+// inheritSockets moves the open sockets of old, the task t replaces, to t when
+// both declare the same sockets
+func (t *Task) inheritSockets(old *Task) {
+	if !reflect.DeepEqual(t.Config.Sockets, old.Config.Sockets) {
+		return
+	}
+	old.activeMu.Lock()
+	sockets := old.sockets
+	old.sockets = nil
+	old.activeMu.Unlock()
+
+	t.activeMu.Lock()
+	t.sockets = sockets
+	t.activeMu.Unlock()
+}
+
+// passSockets passes the sockets of the task to the run, the run fails to start
+// when they can't be opened. The ports lencak listens on for the task aren't
+// checked when the run starts. activeMu must be held.
+func (t *Task) passSockets(tr *TaskRun) {
+	sockets, err := t.openSockets()
+	if err != nil {
+		tr.startErr = err
+		return
+	}
+	bound := t.boundPorts()
+	for name, port := range tr.ports {
+		if bound[port] {
+			delete(tr.ports, name)
+		}
+	}
+	tr.passSockets(sockets)
+}
+
+// passSockets passes sockets to the process of the run as the file descriptors
+// 3 and up following the LISTEN_FDS convention of systemd. The command runs
+// through a shell setting LISTEN_PID, the pid of the process is only known
+// once it started.
+func (tr *TaskRun) passSockets(sockets []*socket) {
+	if len(sockets) == 0 {
+		return
+	}
+	names := make([]string, len(sockets))
+	for i, s := range sockets {
+		tr.Cmd.ExtraFiles = append(tr.Cmd.ExtraFiles, s.file)
+		names[i] = s.name
+	}
+	tr.Environment["LISTEN_FDS"] = strconv.Itoa(len(sockets))
+	tr.Environment["LISTEN_FDNAMES"] = strings.Join(names, ":")
+
+	wrapped := exec.Command("/bin/sh", append([]string{"-c", listenScript, tr.Cmd.Path}, tr.Cmd.Args[1:]...)...)
+	wrapped.ExtraFiles = tr.Cmd.ExtraFiles
+	tr.Cmd = wrapped
+	tr.sockets = sockets
+}
+
+// argv returns the arguments of the command of the run, without the shell
+// passing the sockets, see passSockets
+func (tr *TaskRun) argv() []string {
+	if len(tr.sockets) > 0 {
+		return tr.Cmd.Args[3:]
+	}
+	return tr.Cmd.Args
+}
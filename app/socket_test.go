@@ -0,0 +1,49 @@
+package app
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartSocketActivatedTask(t *testing.T) {
+	cfg, err := Parse(strings.NewReader(`
+name: w
+tasks:
+- name: web
+  executor: [sh, -c]
+  command: 'echo "$LISTEN_FDS $LISTEN_FDNAMES"; exec sleep 5'
+  ports: {PORT: 0}
+  sockets: {http: "127.0.0.1:$PORT"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lenc := NewLencak(map[string]*ConfigWorkspace{"w": cfg})
+	defer lenc.Shutdown()
+
+	run, err := lenc.StartTask("w", "web", false, &RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Error != nil {
+		t.Fatalf("run failed to start: %v", run.Error)
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", run.Environment["PORT"]), time.Second)
+	if err != nil {
+		t.Errorf("socket not listening: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for run.StdoutBuf.String() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	run.Stop("sigkill")
+	run.Wait()
+	if got := run.StdoutBuf.String(); got != "1 http\n" {
+		t.Errorf("output %q, want %q", got, "1 http\n")
+	}
+}
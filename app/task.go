@@ -1,8 +1,10 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
-	"os/exec"
+	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -21,27 +23,90 @@ type Task struct {
 	Stdout      string
 	Stderr      string
 	Pwd         string
+	DependsOn   []string
+	Labels      map[string]string
+	Metadata    map[string]string
 
 	activeMu sync.Mutex
-	ActiveTask *TaskRun
-	TaskRuns   []*TaskRun
+	// the active run of every instance of the task, nil when the instance is not
+	// running, see Scale
+	instances []*TaskRun
+	TaskRuns  []*TaskRun
+	// the ports assigned to the port variables of the task and the ports of every
+	// task of the workspace by published variable, see assignPorts
+	Ports     map[string]int
+	published *portTable
+	// the allocator of the ports of the task and their owner, see checkPorts
+	allocator *portAllocator
+	portOwner string
+
+	// the sockets passed to the runs of the task, see openSockets
+	sockets []*socket
+
+	// called when a run of the task exited, see chainTasks
+	exited func(*TaskRun)
+
+	// closed to stop watching the files of the task, see watchTasks
+	watchMu   sync.Mutex
+	unwatchCh chan struct{}
+
+	// the connections proxied to an on-demand task and its stop when idle, see
+	// connected and beginIdleStop
+	demandMu     sync.Mutex
+	connections  int
+	lastActivity time.Time
+	idleStop     chan struct{}
 
 	serviceMu sync.Mutex
-	Service bool
+	Service   bool
+
+	// the resolved configuration of the task
+	Config *ConfigTask
 }
 
+// maxRunSummaries is the number of runs summarized in the json of a task
+const maxRunSummaries = 10
+
 func (t *Task) MarshalJSON() ([]byte, error) {
+	t.activeMu.Lock()
+	replicas := len(t.instances)
+	running := t.running()
+	ports := t.Ports
+	runs := t.TaskRuns
+	if len(runs) > maxRunSummaries {
+		runs = runs[len(runs)-maxRunSummaries:]
+	}
+	summaries := make([]*runSummary, len(runs))
+	for i, tr := range runs {
+		summaries[i] = tr.summary()
+	}
+	t.activeMu.Unlock()
+
+	t.serviceMu.Lock()
+	service := t.Service
+	t.serviceMu.Unlock()
+
 	return json.Marshal(&struct {
-		ID          int               `json:"id"`
-		Name        string            `json:"name"`
-		Command     string            `json:"command"`
-		Executor    []string          `json:"executor"`
-		Environment map[string]string `json:"environment"`
-		Stdout      string            `json:"stdout,omitempty"`
-		Stderr      string            `json:"stderr,omitempty"`
-		Pwd         string            `json:"pwd"`
-		Service     bool              `json:"service"`
-		Status      string            `json:"status"`
+		ID          int                `json:"id"`
+		Name        string             `json:"name"`
+		Command     string             `json:"command"`
+		Executor    []string           `json:"executor"`
+		Environment map[string]string  `json:"environment"`
+		Stdout      string             `json:"stdout,omitempty"`
+		Stderr      string             `json:"stderr,omitempty"`
+		Pwd         string             `json:"pwd"`
+		DependsOn   []string           `json:"depends_on,omitempty"`
+		Labels      map[string]string  `json:"labels,omitempty"`
+		Metadata    map[string]string  `json:"metadata,omitempty"`
+		Parameters  []*ConfigParameter `json:"parameters,omitempty"`
+		ExtraArgs   bool               `json:"extra_args,omitempty"`
+		Ports       map[string]int     `json:"ports,omitempty"`
+		OnDemand    bool               `json:"on_demand,omitempty"`
+		Service     bool               `json:"service"`
+		Replicas    int                `json:"replicas"`
+		Running     int                `json:"running"`
+		Status      string             `json:"status"`
+		Runs        []*runSummary      `json:"runs"`
 	}{
 		ID:          t.ID,
 		Name:        t.Name,
@@ -51,140 +116,626 @@ func (t *Task) MarshalJSON() ([]byte, error) {
 		Stdout:      t.Stdout,
 		Stderr:      t.Stderr,
 		Pwd:         t.Pwd,
-		Service:     t.Service,
+		DependsOn:   t.DependsOn,
+		Labels:      t.Labels,
+		Metadata:    t.Metadata,
+		Parameters:  t.Config.Parameters,
+		ExtraArgs:   t.Config.ExtraArgs,
+		Ports:       ports,
+		OnDemand:    t.Config.OnDemand,
+		Service:     service,
+		Replicas:    replicas,
+		Running:     running,
 		Status:      t.Status(),
+		Runs:        summaries,
 	})
 }
 
-func NewTask(name string, executor []string, command string, environment map[string]string, service bool, stdout string, stderr string, killSignal  KillSignal, pwd string) *Task {
+// NewTask returns a new task from its resolved configuration, environment holds the
+// workspace environment merged with the environment of the task
+func NewTask(cfg *ConfigTask, environment map[string]string) *Task {
 	environment = AddDefaultVars(environment)
 
 	if _, ok := environment["TASK"]; !ok {
-		environment["TASK"] = name
+		environment["TASK"] = cfg.Name
 	}
 
-	stdout = ReplaceVars(stdout, environment)
-	stderr = ReplaceVars(stderr, environment)
+	stdout := ReplaceVars(cfg.Stdout, environment)
+	stderr := ReplaceVars(cfg.Stderr, environment)
 
 	task := &Task{
-		Name:        name,
-		Command:     command,
-		KillSignal:  killSignal,
+		ID:          cfg.ID,
+		Name:        cfg.Name,
+		Command:     cfg.Command,
+		KillSignal:  cfg.KillSignal,
 		Environment: environment,
 		TaskRuns:    make([]*TaskRun, 0),
-		Service:     service,
-		Executor:    executor,
+		instances:   make([]*TaskRun, cfg.replicas()),
+		Service:     cfg.Service,
+		Executor:    cfg.Executor,
 		Stdout:      stdout,
 		Stderr:      stderr,
-		Pwd:         pwd,
+		Pwd:         cfg.Pwd,
+		DependsOn:   cfg.DependsOn,
+		Labels:      cfg.Labels,
+		Metadata:    cfg.Metadata,
+		Config:      cfg,
 	}
 
 	return task
 }
 
-func (t *Task) Start(sync chan bool) chan int {
+// RunOptions are the parameters and the extra arguments of a run of a task
+type RunOptions struct {
+	Parameters map[string]string
+	Args       []string
+
+	// the watched files whose changes triggered the run
+	changedFiles []string
+	// the chain the run belongs to, what triggered it and its depth in the
+	// chain, see triggerTasks and runPipeline
+	correlation string
+	triggeredBy string
+	depth       int
+	// the outputs of the runs triggering the run or it depends on, added to its
+	// environment
+	outputs map[string]string
+}
+
+func (opts *RunOptions) empty() bool {
+	return opts == nil || (len(opts.Parameters) == 0 && len(opts.Args) == 0)
+}
+
+// validateRunOptions checks opts against the parameters declared by the task:
+// every required parameter must be given, no undeclared one can be, and extra
+// arguments are only accepted when the task allows them
+func (t *Task) validateRunOptions(opts *RunOptions) error {
+	if opts == nil {
+		opts = &RunOptions{}
+	}
+	for _, param := range t.Config.Parameters {
+		if _, ok := opts.Parameters[param.Name]; param.Required && !ok {
+			return fmt.Errorf("task %s: missing parameter %s", t.Name, param.Name)
+		}
+	}
+	for name := range opts.Parameters {
+		if t.parameter(name) == nil {
+			return fmt.Errorf("task %s: unknown parameter %s", t.Name, name)
+		}
+	}
+	if len(opts.Args) > 0 && !t.Config.ExtraArgs {
+		return fmt.Errorf("task %s does not accept extra arguments", t.Name)
+	}
+	return nil
+}
+
+func (t *Task) parameter(name string) *ConfigParameter {
+	for _, param := range t.Config.Parameters {
+		if param.Name == name {
+			return param
+		}
+	}
+	return nil
+}
+
+// Start starts a run of every instance of the task that is not running, see
+// StartWith
+func (t *Task) Start(sync chan bool) (chan int, error) {
+	return t.StartWith(sync, nil)
+}
+
+// StartWith starts a run with opts of every instance of the task that is not
+// running. The exit status of the first run started is sent on the returned
+// channel. A service instance is started again with the same options once its
+// run exited. An error is returned when opts are invalid, e.g a required
+// parameter is missing.
+func (t *Task) StartWith(sync chan bool, opts *RunOptions) (chan int, error) {
+	runs, c, err := t.startInstances(sync, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		return make(chan int, 1), nil
+	}
+	return c, nil
+}
+
+// startInstances starts a run with opts of every instance of the task that is
+// not running, the runs started are returned with the channel the exit status
+// of the first one is sent on. Nothing is started when opts are invalid.
+func (t *Task) startInstances(sync chan bool, opts *RunOptions) ([]*TaskRun, chan int, error) {
+	if err := t.validateRunOptions(opts); err != nil {
+		return nil, nil, err
+	}
+	newRun := func(instance int) *TaskRun {
+		return t.NewTaskRun(instance, opts)
+	}
+
+	t.activeMu.Lock()
+	replicas := len(t.instances)
+	t.activeMu.Unlock()
+
+	var runs []*TaskRun
+	var first chan int
+	for instance := 0; instance < replicas; instance++ {
+		run, c := t.startRun(sync, instance, newRun)
+		if run == nil {
+			continue
+		}
+		if first == nil {
+			first = c
+		}
+		runs = append(runs, run)
+	}
+	return runs, first, nil
+}
+
+// Rerun starts a new run of the task with the argv, the environment and the
+// working directory of its run runID, in the instance of that run unless the
+// instance is running. A service instance is started again the same way once
+// its run exited.
+func (t *Task) Rerun(sync chan bool, runID int) (*TaskRun, error) {
+	t.activeMu.Lock()
+	if runID < 0 || runID >= len(t.TaskRuns) {
+		t.activeMu.Unlock()
+		return nil, notFound("run %d of task %s not found", runID, t.Name)
+	}
+	previous := t.TaskRuns[runID]
+	replicas := len(t.instances)
+	t.activeMu.Unlock()
+
+	if previous.Instance >= replicas {
+		return nil, fmt.Errorf("instance %d of task %s does not exist", previous.Instance, t.Name)
+	}
+	run, _ := t.startRun(sync, previous.Instance, func(instance int) *TaskRun {
+		id := len(t.TaskRuns)
+		stdout, stderr := t.logFiles(id, instance)
+		tr := previous.clone(id, stdout, stderr)
+		tr.setOutputFile(t.outputFile(id))
+		t.passSockets(tr)
+		t.TaskRuns = append(t.TaskRuns, tr)
+		return tr
+	})
+	if run == nil {
+		return nil, fmt.Errorf("task %s is already running", t.Name)
+	}
+	return run, nil
+}
+
+// startRun starts the run returned by newRun in the instance unless the instance
+// is running or doesn't exist, newRun is called with activeMu held. The run
+// started is returned, nil when none was, with the channel its exit status is
+// sent on.
+func (t *Task) startRun(sync chan bool, instance int, newRun func(instance int) *TaskRun) (*TaskRun, chan int) {
+	return t.startAttempt(sync, instance, newRun, nil)
+}
+
+// startAttempt is startRun making the run the attempt following prev, when prev
+// isn't nil, see Task.retry
+func (t *Task) startAttempt(sync chan bool, instance int, newRun func(instance int) *TaskRun, prev *TaskRun) (*TaskRun, chan int) {
 	c1 := make(chan int, 1)
-	if t.ActiveTask == nil {
-		t.activeMu.Lock()
-		t.ActiveTask = t.NewTaskRun()
+	t.activeMu.Lock()
+	if instance >= len(t.instances) || t.instances[instance] != nil {
 		t.activeMu.Unlock()
-		c := make(chan int)
+		return nil, c1
+	}
+	run := newRun(instance)
+	if prev != nil {
+		run.retryOf(prev)
+	}
+	t.instances[instance] = run
+	t.activeMu.Unlock()
+
+	c := make(chan int, 1)
+	select {
+	case sync <- true:
+		log.Infof("success sending event task started for %s", t.Name)
+	default:
+		log.Infof("failed sending event task started for %s", t.Name)
+	}
+
+	run.Start(c)
+
+	go func() {
+		ex := <-c
+		if run.isRetrying() {
+			if next, c := t.retry(sync, instance, run, newRun); next != nil {
+				c1 <- <-c
+				return
+			}
+		}
+		c1 <- ex
 		select {
 		case sync <- true:
-			log.Infof("success sending event task started for %s", t.Name)
+			log.Infof("success sending event task stopped for %s", t.Name)
 		default:
-			log.Infof("failed sending event task started for %s", t.Name)
+			log.Infof("failed sending event task stopped for %s", t.Name)
+		}
+		// a run stopped by Stop was already removed from its instance and
+		// isn't restarted
+		t.activeMu.Lock()
+		stopped := instance >= len(t.instances) || t.instances[instance] != run
+		if !stopped {
+			t.instances[instance] = nil
 		}
+		t.activeMu.Unlock()
 
-		t.ActiveTask.Start(c)
+		t.serviceMu.Lock()
+		service := t.Service
+		t.serviceMu.Unlock()
 
-		go func() {
-			ex := <-c
-			c1 <- ex
-			select {
-			case sync <- true:
-				log.Infof("success sending event task stopped for %s", t.Name)
-			default:
-				log.Infof("failed sending event task stopped for %s", t.Name)
+		if service && !stopped {
+			time.Sleep(time.Second * 1)
+			t.startRun(sync, instance, newRun)
+			return
+		}
+	}()
+	return run, c1
+}
+
+// Scale sets the number of instances of the task to replicas. When the task is
+// running or is a service the new instances are started, the instances removed
+// are stopped.
+func (t *Task) Scale(sync chan bool, replicas int) error {
+	if replicas < 1 {
+		return fmt.Errorf("task %s: replicas must be at least 1", t.Name)
+	}
+	t.activeMu.Lock()
+	previous := len(t.instances)
+	var removed []*TaskRun
+	if replicas < previous {
+		for _, run := range t.instances[replicas:] {
+			if run != nil {
+				removed = append(removed, run)
 			}
-			t.activeMu.Lock()
-			t.ActiveTask = nil
-			t.activeMu.Unlock()
+		}
+		t.instances = t.instances[:replicas]
+	} else {
+		t.instances = append(t.instances, make([]*TaskRun, replicas-previous)...)
+	}
+	running := t.running() > 0
+	t.activeMu.Unlock()
+	t.stopRuns(removed)
 
-			t.serviceMu.Lock()
-			service := t.Service
-			t.serviceMu.Unlock()
+	t.serviceMu.Lock()
+	service := t.Service
+	t.serviceMu.Unlock()
 
-			if service {
-				time.Sleep(time.Second * 1)
-				t.Start(sync)
-				return
-			}
-		}()
+	if replicas > previous && (running || service) {
+		_, err := t.Start(sync)
+		return err
 	}
-	return c1
+	return nil
 }
 
-// Stop stops a task
+// LastRun returns the active run of the first running instance of the task or
+// the last run when the task is not running, nil when the task never ran
+func (t *Task) LastRun() *TaskRun {
+	t.activeMu.Lock()
+	defer t.activeMu.Unlock()
+	for _, run := range t.instances {
+		if run != nil {
+			return run
+		}
+	}
+	if len(t.TaskRuns) == 0 {
+		return nil
+	}
+	return t.TaskRuns[len(t.TaskRuns)-1]
+}
+
+// activeOptions returns the parameters and the extra arguments of the active
+// runs of the task, to restart it with the same options
+func (t *Task) activeOptions() *RunOptions {
+	opts := &RunOptions{}
+	if runs := t.activeRuns(); len(runs) > 0 {
+		opts.Parameters, opts.Args = runs[0].Arguments, runs[0].ExtraArgs
+	}
+	return opts
+}
+
+// activeRuns returns the active runs of the instances of the task
+func (t *Task) activeRuns() []*TaskRun {
+	t.activeMu.Lock()
+	defer t.activeMu.Unlock()
+	var runs []*TaskRun
+	for _, run := range t.instances {
+		if run != nil {
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
+// Stop stops every instance of the task
 func (t *Task) Stop() {
+	t.stopRuns(t.takeRuns())
+}
+
+// takeRuns removes the active runs of the task from their instances and returns
+// them
+func (t *Task) takeRuns() []*TaskRun {
 	t.activeMu.Lock()
 	defer t.activeMu.Unlock()
-	if t.ActiveTask != nil {
-		t.ActiveTask.Stop(t.KillSignal)
-		t.ActiveTask = nil
+	var runs []*TaskRun
+	for i, run := range t.instances {
+		if run != nil {
+			runs = append(runs, run)
+			t.instances[i] = nil
+		}
 	}
+	return runs
 }
 
-func (t *Task) NewTaskRun() *TaskRun {
-	run := len(t.TaskRuns)
+// stopRuns stops runs in parallel, see TaskRun.Stop
+func (t *Task) stopRuns(runs []*TaskRun) {
+	var wg sync.WaitGroup
+	for _, run := range runs {
+		wg.Add(1)
+		go func(run *TaskRun) {
+			defer wg.Done()
+			run.Stop(t.KillSignal)
+		}(run)
+	}
+	wg.Wait()
+}
 
-	c := t.Command
-	c = ReplaceVars(c, t.Environment)
+// Signal sends the signal named name to the active run of every instance of the
+// task
+func (t *Task) Signal(name string) error {
+	t.activeMu.Lock()
+	defer t.activeMu.Unlock()
+	if t.running() == 0 {
+		return fmt.Errorf("task %s is not running", t.Name)
+	}
+	for _, run := range t.instances {
+		if run != nil {
+			if err := run.Signal(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	var cmd *exec.Cmd
-	if len(t.Executor) > 0 {
-		cmd = exec.Command(t.Executor[0], append(t.Executor[1:], c)...)
-	} else {
-		bits := strings.Split(c, " ")
-		cmd = exec.Command(bits[0], bits[1:]...)
+// Reload reloads the active run of every instance of the task with the reload
+// signal or the reload command of the task, the task is restarted when it has
+// neither
+func (t *Task) Reload(sync chan bool) error {
+	runs := t.activeRuns()
+	if len(runs) == 0 {
+		return fmt.Errorf("task %s is not running", t.Name)
+	}
+	if t.Config.ReloadSignal == "" && t.Config.ReloadCommand == "" {
+		return t.Restart(sync, t.activeOptions())
 	}
+	for _, run := range runs {
+		if err := run.Reload(t.Config.ReloadSignal, t.Config.ReloadCommand); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	vars := map[string]string{
-		"TASK": strconv.Itoa(t.ID),
-		"RUN":  strconv.Itoa(run),
+// Restart stops the task then starts it again with opts, a service stays a
+// service. The task is not stopped when opts are invalid.
+func (t *Task) Restart(sync chan bool, opts *RunOptions) error {
+	if err := t.validateRunOptions(opts); err != nil {
+		return err
 	}
-	if len(t.Pwd) > 0 {
-		vars["PWD"] = t.Pwd
+	t.serviceMu.Lock()
+	service := t.Service
+	t.serviceMu.Unlock()
+
+	t.Shutdown(stopTimeout)
+	if service {
+		t.serviceMu.Lock()
+		t.Service = true
+		t.serviceMu.Unlock()
 	}
+	_, err := t.StartWith(sync, opts)
+	return err
+}
 
-	stdout := ReplaceVars(t.Stdout, vars)
-	stderr := ReplaceVars(t.Stderr, vars)
+// Shutdown disables the service restart of the task, stops the active runs and
+// waits for them to exit. A run is killed when it did not exit after timeout.
+func (t *Task) Shutdown(timeout time.Duration) {
+	t.serviceMu.Lock()
+	t.Service = false
+	t.serviceMu.Unlock()
 
-	tr := &TaskRun{
-		Id:          run,
-		Events:      make([]*Event, 0),
-		Cmd:         cmd,
-		Command:     t.Command,
-		Environment: make(map[string]string),
-		Stdout:      stdout,
-		Stderr:      stderr,
-		Pwd:         t.Pwd,
+	t.stopWithin(timeout)
+}
+
+// stopWithin stops the active runs of the task and waits for them to exit, a run
+// is killed when it did not exit after timeout, its stop hook and command
+// included. The service restart of the task is kept.
+func (t *Task) stopWithin(timeout time.Duration) {
+	runs := t.takeRuns()
+	if len(runs) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go t.stopRuns(runs)
+	t.awaitRuns(ctx, runs)
+}
+
+// awaitRuns waits for runs of the task being stopped to exit, the runs still
+// running when ctx is done are killed
+func (t *Task) awaitRuns(ctx context.Context, runs []*TaskRun) {
+	for _, run := range runs {
+		select {
+		case <-run.done:
+		case <-ctx.Done():
+			log.Warnf("task %s did not stop in time, killing it", t.Name)
+			run.kill("sigkill")
+			run.Wait()
+		}
+	}
+}
+
+// inheritRuns makes the runs of old, the task t replaces, the first runs of t
+func (t *Task) inheritRuns(old *Task) {
+	old.activeMu.Lock()
+	runs := append([]*TaskRun{}, old.TaskRuns...)
+	old.activeMu.Unlock()
+
+	t.activeMu.Lock()
+	t.TaskRuns = append(runs, t.TaskRuns...)
+	t.activeMu.Unlock()
+}
+
+// definitionChanged returns true when other would run a different process than t,
+// i.e its command, environment, working directory, executor, ports, port
+// offset or sockets differ.
+func (t *Task) definitionChanged(other *Task) bool {
+	return t.Command != other.Command ||
+		t.Pwd != other.Pwd ||
+		t.Config.PortOffset != other.Config.PortOffset ||
+		!reflect.DeepEqual(t.Config.Ports, other.Config.Ports) ||
+		!reflect.DeepEqual(t.Config.Sockets, other.Config.Sockets) ||
+		!reflect.DeepEqual(t.Executor, other.Executor) ||
+		!reflect.DeepEqual(t.Environment, other.Environment)
+}
+
+// NewTaskRun returns a new run of the instance of the task. $INSTANCE, the ports
+// of the task and the ports published by the tasks of the workspace are added to
+// the environment of the run, $PORT and the ports of the task are offset by the
+// instance when the task has a port offset. The parameters of opts and the
+// defaults of the parameters not given are added to the environment too, and the
+// extra arguments are appended to the command. The outputs of opts can't override any of those
+// variables nor the environment of the task.
+func (t *Task) NewTaskRun(instance int, opts *RunOptions) *TaskRun {
+	if opts == nil {
+		opts = &RunOptions{}
 	}
+	run := len(t.TaskRuns)
+	stdout, stderr := t.logFiles(run, instance)
+	moved, portsErr := t.checkPorts(instance)
 
+	// the outputs can't override the variables of the task or set by lencak
+	env := make(map[string]string)
+	for k, v := range opts.outputs {
+		env[k] = v
+	}
 	for k, v := range t.Environment {
-		tr.Environment[k] = v
+		env[k] = v
+	}
+	env["INSTANCE"] = strconv.Itoa(instance)
+	for k, v := range t.published.get() {
+		env[k] = v
+	}
+	for name, port := range t.Ports {
+		env[name] = strconv.Itoa(port)
+	}
+	if t.Config.PortOffset != 0 {
+		for _, name := range append([]string{"PORT"}, sortedKeys(t.Ports)...) {
+			if port, err := strconv.Atoi(env[name]); err == nil {
+				env[name] = strconv.Itoa(port + instance*t.Config.PortOffset)
+			}
+		}
 	}
 
+	params := make(map[string]string)
+	for _, param := range t.Config.Parameters {
+		if value, ok := opts.Parameters[param.Name]; ok {
+			params[param.Name] = value
+		} else if param.Default != "" {
+			params[param.Name] = param.Default
+		}
+	}
+
+	tr := newTaskRun(run, t.Command, t.Executor, env, params, t.Pwd, stdout, stderr)
+	tr.Instance = instance
+	tr.startErr = portsErr
+	for _, msg := range moved {
+		tr.addEvent("%s", msg)
+	}
+	tr.hooks = t.Config.hooks()
+	tr.stopCommand = t.Config.StopCommand
+	tr.hookTimeout = t.Config.hookTimeout()
+	tr.exited = t.exited
+	tr.Correlation = opts.correlation
+	if t.Config.Retries > 0 {
+		tr.Attempt = 1
+		tr.retries = t.Config.Retries
+		tr.retryOn = t.Config.RetryOn
+		tr.retryBackoff = t.Config.retryBackoff()
+	}
+	if opts.triggeredBy != "" {
+		tr.TriggeredBy = opts.triggeredBy
+		tr.depth = opts.depth
+		tr.addEvent("Triggered by %s", opts.triggeredBy)
+	}
+	if len(opts.changedFiles) > 0 {
+		tr.ChangedFiles = opts.changedFiles
+		tr.addEvent("Triggered by changes to %s", strings.Join(opts.changedFiles, ", "))
+	}
+	// instances sharing their ports can't check them
+	if len(t.instances) == 1 || t.Config.PortOffset != 0 {
+		tr.ports = make(map[string]int)
+		for name := range t.Ports {
+			tr.ports[name], _ = strconv.Atoi(env[name])
+		}
+	}
+	if len(params) > 0 {
+		tr.Arguments = params
+	}
+	tr.appendArgs(opts.Args)
+	tr.setOutputFile(t.outputFile(run))
+	t.passSockets(tr)
 	t.TaskRuns = append(t.TaskRuns, tr)
 	return tr
 }
 
-// Status returns a string representation of the current task status
+// logFiles returns the files the output of the run numbered run of the instance
+// is written to
+func (t *Task) logFiles(run, instance int) (stdout, stderr string) {
+	vars := map[string]string{
+		"TASK":     strconv.Itoa(t.ID),
+		"RUN":      strconv.Itoa(run),
+		"INSTANCE": strconv.Itoa(instance),
+	}
+	if len(t.Pwd) > 0 {
+		vars["PWD"] = t.Pwd
+	}
+	return ReplaceVars(t.Stdout, vars), ReplaceVars(t.Stderr, vars)
+}
+
+// running returns the number of running instances, activeMu must be held
+func (t *Task) running() int {
+	n := 0
+	for _, run := range t.instances {
+		if run != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Running returns true when an instance of the task is running
+func (t *Task) Running() bool {
+	t.activeMu.Lock()
+	defer t.activeMu.Unlock()
+	return t.running() > 0
+}
+
+// Status returns a string representation of the current task status, the
+// running instances out of the replicas when the task has several, e.g "3/4
+// running", or "Idle (on-demand)" for an on-demand task that is not running
 func (t *Task) Status() string {
 	t.activeMu.Lock()
 	defer t.activeMu.Unlock()
-	if t.ActiveTask != nil {
-		return "Running"
+	running := t.running()
+	switch {
+	case running == 0 && t.Config.OnDemand:
+		return "Idle (on-demand)"
+	case running == 0:
+		return "Stopped"
+	case len(t.instances) > 1:
+		return fmt.Sprintf("%d/%d running", running, len(t.instances))
 	}
-	return "Stopped"
+	return "Running"
 }
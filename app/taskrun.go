@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"os/exec"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -18,6 +20,7 @@ type TaskRun struct {
 	Started     time.Time
 	Stopped     time.Time
 	Events      []*Event
+	eventsMu    sync.Mutex
 	Command     string
 	Stdout      string
 	Stderr      string
@@ -27,6 +30,62 @@ type TaskRun struct {
 	Executor    []string
 	WaitStatus  syscall.WaitStatus
 	Pwd         string
+	// the arguments of a function call or the parameters of a task run
+	Arguments map[string]string
+	// the arguments appended to the command of a task run
+	ExtraArgs []string
+	// the id of the run this run is a re-run of
+	RerunOf *int
+	// the instance of the task the run belongs to, see Task.Scale
+	Instance int
+	// the watched files whose changes triggered the run
+	ChangedFiles []string
+	// the chain of triggered runs the run belongs to and the run that triggered
+	// it, see triggerTasks
+	Correlation string
+	TriggeredBy string
+	// the attempt of the run and the id of the first attempt of its execution,
+	// when the task retries failed runs, see Task.retry
+	Attempt int
+	RetryOf *int
+	// the variables written by the run to its $LENCAK_OUTPUT file
+	Outputs map[string]string
+	// the file of $LENCAK_OUTPUT, see readOutputs
+	outputFile string
+	// the ports of the task checked before the process starts, by variable
+	ports map[string]int
+	// the sockets passed to the process, see passSockets
+	sockets []*socket
+	// prevents the process from starting, e.g a socket that could not be opened
+	startErr error
+	// the hook commands of the run by name, see runHook
+	hooks map[string]string
+	// the command stopping the process instead of the kill signal
+	stopCommand string
+	// the time given to the hooks, the stop and the reload commands, see runCommand
+	hookTimeout time.Duration
+	// called once the process exited or failed to start, see chainTasks
+	exited func(*TaskRun)
+	// the number of runs that triggered the run in its chain
+	depth int
+	// set when lencak stopped the run, its exit triggers no task. Guarded by
+	// retryMu, see isStopRequested
+	stopRequested bool
+	// the retry policy of the run: the attempts left, the exit statuses retried,
+	// any when empty, and the delay before the next attempt
+	retries      int
+	retryOn      []int
+	retryBackoff time.Duration
+	// set when the run failed and is retried, cleared when the retry was
+	// abandoned. retried is closed once the next attempt started or the retry
+	// was abandoned, see WaitAttempts. Guarded by retryMu.
+	retrying bool
+	retryMu  sync.Mutex
+	retried  chan struct{}
+	next     *TaskRun
+
+	// closed once the process exited or failed to start
+	done chan struct{}
 }
 
 // Event represents an event
@@ -35,41 +94,254 @@ type Event struct {
 	Message string    `json:"message"`
 }
 
+// newTaskRun returns a run of command with the variables of environment replaced.
+// The command is passed to the executor when one is given, otherwise it's split
+// on spaces. The arguments, given by the caller of the run, are only added to
+// the environment: the executor expands them itself, without one they are
+// replaced in the arguments of the command once split. Their values can never
+// change the command.
+func newTaskRun(id int, command string, executor []string, environment, args map[string]string, pwd, stdout, stderr string) *TaskRun {
+	argv := commandArgv(command, executor, environment, args)
+	cmd := exec.Command(argv[0], argv[1:]...)
+
+	tr := &TaskRun{
+		Id:          id,
+		Events:      make([]*Event, 0),
+		Cmd:         cmd,
+		Command:     command,
+		Environment: make(map[string]string),
+		Executor:    executor,
+		Stdout:      stdout,
+		Stderr:      stderr,
+		Pwd:         pwd,
+		done:        make(chan struct{}),
+		retried:     make(chan struct{}),
+	}
+
+	for k, v := range environment {
+		tr.Environment[k] = v
+	}
+	for k, v := range args {
+		tr.Environment[k] = v
+	}
+	return tr
+}
+
+// commandArgv returns the argv running command with executor. The variables of
+// environment are replaced in the command, the arguments are only replaced in
+// the arguments of a command without executor so that they're a single word.
+func commandArgv(command string, executor []string, environment, args map[string]string) []string {
+	c := ReplaceVars(command, withoutVars(environment, args))
+	if len(executor) > 0 {
+		return append(append([]string{}, executor...), c)
+	}
+	bits := strings.Split(c, " ")
+	for i := 1; i < len(bits) && len(args) > 0; i++ {
+		bits[i] = ReplaceVars(bits[i], copyVars(args))
+	}
+	return bits
+}
+
+// withoutVars returns a copy of vars without the variables of other
+func withoutVars(vars, other map[string]string) map[string]string {
+	copied := make(map[string]string)
+	for k, v := range vars {
+		if _, ok := other[k]; !ok {
+			copied[k] = v
+		}
+	}
+	return copied
+}
+
+// copyVars returns a copy of vars, ReplaceVars adds the default variables to
+// the map it's given
+func copyVars(vars map[string]string) map[string]string {
+	return withoutVars(vars, nil)
+}
+
+// clone returns a new run with the argv, the environment and the working
+// directory of tr, its output is written to stdout and stderr
+func (tr *TaskRun) clone(id int, stdout, stderr string) *TaskRun {
+	args := tr.argv()
+	rerunOf := tr.Id
+	run := &TaskRun{
+		Id:           id,
+		Events:       []*Event{{time.Now(), fmt.Sprintf("Re-run of run %d", tr.Id)}},
+		Cmd:          exec.Command(args[0], args[1:]...),
+		Command:      tr.Command,
+		Environment:  make(map[string]string),
+		Executor:     tr.Executor,
+		Stdout:       stdout,
+		Stderr:       stderr,
+		Pwd:          tr.Pwd,
+		Arguments:    tr.Arguments,
+		ExtraArgs:    tr.ExtraArgs,
+		RerunOf:      &rerunOf,
+		Instance:     tr.Instance,
+		ports:        tr.ports,
+		hooks:        tr.hooks,
+		stopCommand:  tr.stopCommand,
+		hookTimeout:  tr.hookTimeout,
+		exited:       tr.exited,
+		retryOn:      tr.retryOn,
+		retryBackoff: tr.retryBackoff,
+		retried:      make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	// a re-run is a new execution with every attempt of the task
+	if tr.Attempt > 0 {
+		run.Attempt = 1
+		run.retries = tr.retries + tr.Attempt - 1
+	}
+	for k, v := range tr.Environment {
+		run.Environment[k] = v
+	}
+	return run
+}
+
+// appendArgs appends args to the command of the run. The executor receives the
+// command as a single argument, the arguments are quoted for a shell then.
+func (tr *TaskRun) appendArgs(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	tr.ExtraArgs = args
+	if len(tr.Executor) > 0 {
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = shellQuote(arg)
+		}
+		last := len(tr.Cmd.Args) - 1
+		tr.Cmd.Args[last] += " " + strings.Join(quoted, " ")
+	} else {
+		tr.Cmd.Args = append(tr.Cmd.Args, args...)
+	}
+}
+
+// shellQuote quotes s for a posix shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// runSummary describes a run without its output and environment
+type runSummary struct {
+	Id           int               `json:"id"`
+	Started      time.Time         `json:"started"`
+	Stopped      *time.Time        `json:"stopped,omitempty"`
+	ExitStatus   *int              `json:"exit_status,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	Arguments    map[string]string `json:"arguments,omitempty"`
+	ExtraArgs    []string          `json:"extra_args,omitempty"`
+	RerunOf      *int              `json:"rerun_of,omitempty"`
+	Instance     int               `json:"instance"`
+	ChangedFiles []string          `json:"changed_files,omitempty"`
+	Correlation  string            `json:"correlation,omitempty"`
+	TriggeredBy  string            `json:"triggered_by,omitempty"`
+	Outputs      map[string]string `json:"outputs,omitempty"`
+	Attempt      int               `json:"attempt,omitempty"`
+	RetryOf      *int              `json:"retry_of,omitempty"`
+}
+
+func (tr *TaskRun) summary() *runSummary {
+	s := &runSummary{
+		Id:           tr.Id,
+		Started:      tr.Started,
+		Arguments:    tr.Arguments,
+		ExtraArgs:    tr.ExtraArgs,
+		RerunOf:      tr.RerunOf,
+		Instance:     tr.Instance,
+		ChangedFiles: tr.ChangedFiles,
+		Correlation:  tr.Correlation,
+		TriggeredBy:  tr.TriggeredBy,
+		Outputs:      tr.Outputs,
+		Attempt:      tr.Attempt,
+		RetryOf:      tr.RetryOf,
+	}
+	if !tr.Stopped.IsZero() {
+		stopped := tr.Stopped
+		status := tr.WaitStatus.ExitStatus()
+		s.Stopped = &stopped
+		s.ExitStatus = &status
+	}
+	if tr.Error != nil {
+		s.Error = tr.Error.Error()
+	}
+	return s
+}
+
 func (tr *TaskRun) MarshalJSON() ([]byte, error) {
 	var err = ""
 	if tr.Error != nil {
 		err = tr.Error.Error()
 	}
+	var pid int
+	if tr.Cmd.Process != nil {
+		pid = tr.Cmd.Process.Pid
+	}
+	var exitStatus *int
+	if !tr.Stopped.IsZero() {
+		status := tr.WaitStatus.ExitStatus()
+		exitStatus = &status
+	}
+	var stdoutBuf, stderrBuf string
+	if tr.StdoutBuf != nil {
+		stdoutBuf = tr.StdoutBuf.String()
+	}
+	if tr.StderrBuf != nil {
+		stderrBuf = tr.StderrBuf.String()
+	}
 	return json.Marshal(&struct {
-		Id          int               `json:"id"`
-		Pid         int               `json:"pid,omitempty"`
-		Error       string            `json:"error"`
-		Started     time.Time         `json:"started"`
-		Stopped     time.Time         `json:"stopped"`
-		Events      []*Event          `jaon:"events"`
-		Command     string            `json:"command"`
-		Stdout      string            `json:"stdout,omitempty"`
-		Stderr      string            `json:"stderr,omitempty"`
-		StdoutBuf   string            `json:"stdoutbuf"`
-		StderrBuf   string            `json:"stderrbuf"`
-		Environment map[string]string `json:"environment"`
-		Executor    []string          `json:"executor"`
-		Pwd         string            `json:"pwd"`
+		Id           int               `json:"id"`
+		Pid          int               `json:"pid,omitempty"`
+		Error        string            `json:"error"`
+		Started      time.Time         `json:"started"`
+		Stopped      time.Time         `json:"stopped"`
+		ExitStatus   *int              `json:"exit_status,omitempty"`
+		Events       []*Event          `json:"events"`
+		Command      string            `json:"command"`
+		Stdout       string            `json:"stdout,omitempty"`
+		Stderr       string            `json:"stderr,omitempty"`
+		StdoutBuf    string            `json:"stdoutbuf"`
+		StderrBuf    string            `json:"stderrbuf"`
+		Environment  map[string]string `json:"environment"`
+		Executor     []string          `json:"executor"`
+		Pwd          string            `json:"pwd"`
+		Arguments    map[string]string `json:"arguments,omitempty"`
+		ExtraArgs    []string          `json:"extra_args,omitempty"`
+		RerunOf      *int              `json:"rerun_of,omitempty"`
+		Instance     int               `json:"instance"`
+		ChangedFiles []string          `json:"changed_files,omitempty"`
+		Correlation  string            `json:"correlation,omitempty"`
+		TriggeredBy  string            `json:"triggered_by,omitempty"`
+		Outputs      map[string]string `json:"outputs,omitempty"`
+		Attempt      int               `json:"attempt,omitempty"`
+		RetryOf      *int              `json:"retry_of,omitempty"`
 	}{
-		Id:          tr.Id,
-		Pid:         tr.Cmd.Process.Pid,
-		Error:       err,
-		Events:      tr.Events,
-		Started:     tr.Started,
-		Stopped:     tr.Stopped,
-		Command:     tr.Command,
-		Stdout:      tr.Stdout,
-		Stderr:      tr.Stderr,
-		StdoutBuf:   tr.StdoutBuf.String(),
-		StderrBuf:   tr.StderrBuf.String(),
-		Environment: tr.Environment,
-		Executor:    tr.Executor,
-		Pwd:         tr.Pwd,
+		Id:           tr.Id,
+		Pid:          pid,
+		Error:        err,
+		Events:       tr.events(),
+		Started:      tr.Started,
+		Stopped:      tr.Stopped,
+		ExitStatus:   exitStatus,
+		Command:      tr.Command,
+		Stdout:       tr.Stdout,
+		Stderr:       tr.Stderr,
+		StdoutBuf:    stdoutBuf,
+		StderrBuf:    stderrBuf,
+		Environment:  tr.Environment,
+		Executor:     tr.Executor,
+		Pwd:          tr.Pwd,
+		Arguments:    tr.Arguments,
+		ExtraArgs:    tr.ExtraArgs,
+		RerunOf:      tr.RerunOf,
+		Instance:     tr.Instance,
+		ChangedFiles: tr.ChangedFiles,
+		Correlation:  tr.Correlation,
+		TriggeredBy:  tr.TriggeredBy,
+		Outputs:      tr.Outputs,
+		Attempt:      tr.Attempt,
+		RetryOf:      tr.RetryOf,
 	})
 }
 
@@ -80,16 +352,35 @@ func (tr *TaskRun) String() string {
 func (tr *TaskRun) Start(exitCh chan int) {
 	tr.Started = time.Now()
 
+	err := tr.startErr
+	if err == nil {
+		err = portsInUse(tr.ports)
+	}
+	if err == nil {
+		err = tr.createOutputFile()
+	}
+	if err == nil {
+		if err = tr.runHook("before_start"); err != nil {
+			err = fmt.Errorf("before_start hook failed: %v", err)
+		}
+	}
+	if err != nil {
+		tr.Error = err
+		log.Error(err.Error())
+		tr.exit(exitCh, 1)
+		return
+	}
+
 	stdout, err := tr.Cmd.StdoutPipe()
 	if err != nil {
 		tr.Error = err
-		exitCh <- 1
+		tr.exit(exitCh, 1)
 		return
 	}
 	stderr, err := tr.Cmd.StderrPipe()
 	if err != nil {
 		tr.Error = err
-		exitCh <- 1
+		tr.exit(exitCh, 1)
 		return
 	}
 
@@ -128,21 +419,32 @@ func (tr *TaskRun) Start(exitCh chan int) {
 
 	err = tr.Cmd.Start()
 	if tr.Cmd.Process != nil {
-		ev := &Event{time.Now(), fmt.Sprintf("Process %d started: %s", tr.Cmd.Process.Pid, tr.Command)}
-		log.Info(ev.Message)
-		tr.Events = append(tr.Events, ev)
+		tr.addEvent("Process %d started: %s", tr.Cmd.Process.Pid, tr.Command)
+	}
+	if err == nil {
+		go tr.runHook("after_start")
 	}
 	if err != nil {
 		tr.Error = err
 		log.Error(err.Error())
 		tr.StdoutBuf.Close()
 		tr.StderrBuf.Close()
-		exitCh <- 1
+		tr.exit(exitCh, 1)
 		return
 	}
 	go func() {
-		go io.Copy(tr.StdoutBuf, stdout)
-		go io.Copy(tr.StderrBuf, stderr)
+		// the pipes must be drained before waiting, Wait closes them
+		var copies sync.WaitGroup
+		copies.Add(2)
+		go func() {
+			io.Copy(tr.StdoutBuf, stdout)
+			copies.Done()
+		}()
+		go func() {
+			io.Copy(tr.StderrBuf, stderr)
+			copies.Done()
+		}()
+		copies.Wait()
 
 		tr.Cmd.Wait()
 
@@ -151,6 +453,7 @@ func (tr *TaskRun) Start(exitCh chan int) {
 
 		ps := tr.Cmd.ProcessState
 		sy := ps.Sys().(syscall.WaitStatus)
+		tr.WaitStatus = sy
 
 		if sy.ExitStatus() == 0 {
 			log.Infof("STDOUT: %s", tr.StdoutBuf.String())
@@ -160,17 +463,98 @@ func (tr *TaskRun) Start(exitCh chan int) {
 			log.Errorf("STDERR: %s", tr.StderrBuf.String())
 		}
 
-		ev := &Event{time.Now(), fmt.Sprintf("Process %d exited with status %d", ps.Pid(), sy.ExitStatus())}
-		log.Info(ev.Message)
-		tr.Events = append(tr.Events, ev)
+		tr.addEvent("Process %d exited with status %d", ps.Pid(), sy.ExitStatus())
 		log.Info(ps.String())
 
+		tr.runHook("after_stop")
+		tr.retryMu.Lock()
+		tr.retrying = tr.shouldRetry(sy.ExitStatus())
+		tr.retryMu.Unlock()
+
 		tr.Stopped = time.Now()
-		exitCh <- 0
+		tr.exit(exitCh, sy.ExitStatus())
 	}()
 }
 
+// addEvent records an event on the run, the events of a run are recorded by
+// the goroutines of its process, hooks and commands
+func (tr *TaskRun) addEvent(format string, args ...interface{}) {
+	ev := &Event{time.Now(), fmt.Sprintf(format, args...)}
+	log.Info(ev.Message)
+
+	tr.eventsMu.Lock()
+	defer tr.eventsMu.Unlock()
+	tr.Events = append(tr.Events, ev)
+}
+
+// events returns a copy of the events of the run
+func (tr *TaskRun) events() []*Event {
+	tr.eventsMu.Lock()
+	defer tr.eventsMu.Unlock()
+	events := make([]*Event, len(tr.Events))
+	copy(events, tr.Events)
+	return events
+}
+
+// exit reads the outputs of the run, marks it done and sends its exit status on
+// exitCh, the tasks the run triggers are started
+func (tr *TaskRun) exit(exitCh chan int, status int) {
+	tr.readOutputs()
+	close(tr.done)
+	// the last attempt triggers the tasks
+	if tr.exited != nil && !tr.isRetrying() {
+		go tr.exited(tr)
+	}
+	exitCh <- status
+}
+
+// Wait blocks until the process of the run exited
+func (tr *TaskRun) Wait() {
+	<-tr.done
+}
+
+// Stop runs the before_stop hook of the run then stops its process: the stop
+// command of the run is run and the process is given stopTimeout to exit before
+// it gets the kill signal, the signal is sent right away without a stop command
+// or when the stop command failed.
 func (tr *TaskRun) Stop(kill KillSignal) {
+	if tr.Cmd == nil || tr.Cmd.Process == nil {
+		return
+	}
+	select {
+	case <-tr.done:
+		return
+	default:
+	}
+	tr.retryMu.Lock()
+	tr.stopRequested = true
+	tr.retryMu.Unlock()
+	tr.runHook("before_stop")
+	if tr.stopCommand == "" {
+		tr.kill(kill)
+		return
+	}
+
+	failed := make(chan error, 1)
+	go func() {
+		if err := tr.runCommand("Stop command", tr.stopCommand); err != nil {
+			failed <- err
+		}
+	}()
+	select {
+	case <-tr.done:
+	case <-failed:
+		tr.addEvent("Stop command of process %d failed, sending the kill signal", tr.Cmd.Process.Pid)
+		tr.kill(kill)
+	case <-time.After(stopTimeout):
+		tr.addEvent("Process %d did not exit %s after the stop command, sending the kill signal", tr.Cmd.Process.Pid, stopTimeout)
+		tr.kill(kill)
+	}
+}
+
+// kill sends the kill signal to the process of the run, sigint or sigterm, any
+// other signal kills the process
+func (tr *TaskRun) kill(kill KillSignal) {
 	if tr.Cmd == nil || tr.Cmd.Process == nil {
 		return
 	}
@@ -180,8 +564,21 @@ func (tr *TaskRun) Stop(kill KillSignal) {
 	case "sigint":
 		tr.Cmd.Process.Signal(syscall.SIGINT)
 	case "sigterm":
-		tr.Cmd.Process.Signal(syscall.SIGINT)
+		tr.Cmd.Process.Signal(syscall.SIGTERM)
 	default:
 		tr.Cmd.Process.Kill()
 	}
 }
+
+// Reload reloads the process of the run in place with the signal named signal
+// or, without a signal, by running command
+func (tr *TaskRun) Reload(signal, command string) error {
+	if tr.Cmd == nil || tr.Cmd.Process == nil {
+		return fmt.Errorf("process not started")
+	}
+	tr.addEvent("Reloading process %d", tr.Cmd.Process.Pid)
+	if signal != "" {
+		return tr.Signal(signal)
+	}
+	return tr.runCommand("Reload command", command)
+}
@@ -0,0 +1,153 @@
+package app
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// resolveTasks applies the workspace defaults and the templates a task extends
+// to every task of the workspace. A task is resolved by starting from the
+// defaults, merging the templates from the most generic to the one the task
+// extends and finally the task itself. See mergeConfig for the merge rules.
+func (cfg *ConfigWorkspace) resolveTasks() ValidationErrors {
+	var errs ValidationErrors
+	for i, t := range cfg.Tasks {
+		if t == nil {
+			continue
+		}
+		chain, err := cfg.templateChain(t.Extends)
+		if err != nil {
+			errs = append(errs, &ConfigError{File: t.file, Line: t.line, Task: t.Name, Message: err.Error()})
+			continue
+		}
+
+		resolved := &ConfigTask{}
+		if cfg.Defaults != nil {
+			mergeConfig(resolved, cfg.Defaults)
+		}
+		for j := len(chain) - 1; j >= 0; j-- {
+			mergeConfig(resolved, chain[j])
+		}
+		mergeConfig(resolved, t)
+		resolved.Name = t.Name
+		resolved.Extends = ""
+		resolved.file = t.file
+		resolved.line = t.line
+		cfg.Tasks[i] = resolved
+	}
+	return errs
+}
+
+// templateChain returns the template name and the templates it extends, the
+// template name refers to comes first
+func (cfg *ConfigWorkspace) templateChain(name string) ([]*ConfigTask, error) {
+	var chain []*ConfigTask
+	var names []string
+	for name != "" {
+		if containsString(names, name) {
+			return nil, fmt.Errorf("template cycle: %s -> %s", strings.Join(names, " -> "), name)
+		}
+		tmpl, ok := cfg.Templates[name]
+		if !ok || tmpl == nil {
+			return nil, fmt.Errorf("extends undefined template %q", name)
+		}
+		names = append(names, name)
+		chain = append(chain, tmpl)
+		name = tmpl.Extends
+	}
+	return chain, nil
+}
+
+// mergeConfig deep merges the task src into dst
+//   - maps are merged key by key, the keys of src override the keys of dst
+//   - lists replace the list of dst when they are set, an empty list clears it
+//   - nested structs are merged field by field, pointers to values other than
+//     structs replace the pointer of dst when they are set
+//   - any other value replaces the value of dst when it's not the zero value or
+//     when its key is set in the file of src, e.g service: false
+func mergeConfig(dst, src *ConfigTask) {
+	mergeValue(reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem(), src.set)
+	for k := range src.set {
+		if dst.set == nil {
+			dst.set = make(map[string]bool)
+		}
+		dst.set[k] = true
+	}
+}
+
+// yamlKey returns the key of a struct field in yaml
+func yamlKey(field reflect.StructField) string {
+	if tag := strings.Split(field.Tag.Get("yaml"), ",")[0]; tag != "" {
+		return tag
+	}
+	return strings.ToLower(field.Name)
+}
+
+// mergeValue merges src into dst, set are the keys of the fields of src set
+// explicitly when src is a struct
+func mergeValue(dst, src reflect.Value, set map[string]bool) {
+	switch src.Kind() {
+	case reflect.Struct:
+		for i := 0; i < src.NumField(); i++ {
+			field := src.Type().Field(i)
+			if field.PkgPath != "" {
+				// unexported
+				continue
+			}
+			if set[yamlKey(field)] && isScalar(field.Type.Kind()) {
+				dst.Field(i).Set(src.Field(i))
+				continue
+			}
+			mergeValue(dst.Field(i), src.Field(i), nil)
+		}
+
+	case reflect.Map:
+		if src.Len() == 0 {
+			return
+		}
+		merged := reflect.MakeMap(src.Type())
+		for _, k := range dst.MapKeys() {
+			merged.SetMapIndex(k, dst.MapIndex(k))
+		}
+		for _, k := range src.MapKeys() {
+			merged.SetMapIndex(k, src.MapIndex(k))
+		}
+		dst.Set(merged)
+
+	case reflect.Ptr:
+		if src.IsNil() {
+			return
+		}
+		if src.Elem().Kind() != reflect.Struct {
+			// a pointer distinguishes an explicit zero value from an unset one
+			dst.Set(src)
+			return
+		}
+		merged := reflect.New(src.Type().Elem())
+		if !dst.IsNil() {
+			merged.Elem().Set(dst.Elem())
+		}
+		mergeValue(merged.Elem(), src.Elem(), nil)
+		dst.Set(merged)
+
+	case reflect.Slice:
+		if !src.IsNil() {
+			dst.Set(src)
+		}
+
+	default:
+		if !src.IsZero() {
+			dst.Set(src)
+		}
+	}
+}
+
+// isScalar returns true for the kinds merged by replacing the value of dst
+func isScalar(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Struct, reflect.Map, reflect.Ptr, reflect.Slice:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func parseTask(t *testing.T, src string) *ConfigTask {
+	t.Helper()
+	cfg, err := Parse(strings.NewReader("tasks: [" + src + "]"))
+	if err != nil {
+		t.Fatalf("parsing %q: %v", src, err)
+	}
+	return cfg.Tasks[0]
+}
+
+func TestMergeConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		dst  string
+		src  string
+		want ConfigTask
+	}{
+		{
+			name: "scalars of src override",
+			dst:  "{command: a, service: true, replicas: 2}",
+			src:  "{command: b}",
+			want: ConfigTask{Command: "b", Service: true, Replicas: 2},
+		},
+		{
+			name: "explicit zero values override",
+			dst:  "{command: a, service: true, extra_args: true, replicas: 2, pwd: /tmp}",
+			src:  "{service: false, extra_args: false, replicas: 0, pwd: ''}",
+			want: ConfigTask{Command: "a"},
+		},
+		{
+			name: "maps are merged by key",
+			dst:  "{environment: {A: '1', B: '2'}}",
+			src:  "{environment: {B: '3', C: '4'}}",
+			want: ConfigTask{Environment: map[string]string{"A": "1", "B": "3", "C": "4"}},
+		},
+		{
+			name: "lists are replaced",
+			dst:  "{executor: [sh, -c], depends_on: [db]}",
+			src:  "{executor: [bash, -c]}",
+			want: ConfigTask{Executor: []string{"bash", "-c"}, DependsOn: []string{"db"}},
+		},
+		{
+			name: "an empty list clears",
+			dst:  "{depends_on: [db]}",
+			src:  "{depends_on: []}",
+			want: ConfigTask{DependsOn: []string{}},
+		},
+		{
+			name: "nested structs are merged by field",
+			dst:  "{watch: {paths: [src], debounce: 1s}}",
+			src:  "{watch: {include: ['*.go']}}",
+			want: ConfigTask{Watch: &ConfigWatch{Paths: []string{"src"}, Include: []string{"*.go"}, Debounce: "1s"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := parseTask(t, tt.dst)
+			mergeConfig(dst, parseTask(t, tt.src))
+			dst.set = nil
+			if !reflect.DeepEqual(*dst, tt.want) {
+				t.Errorf("got %+v, want %+v", *dst, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplateChain(t *testing.T) {
+	cfg := &ConfigWorkspace{Templates: map[string]*ConfigTask{
+		"base":    {Command: "base"},
+		"web":     {Command: "web", Extends: "base"},
+		"api":     {Command: "api", Extends: "web"},
+		"loop":    {Extends: "cycle"},
+		"cycle":   {Extends: "loop"},
+		"dangles": {Extends: "missing"},
+	}}
+	tests := []struct {
+		name string
+		want []string
+		err  string
+	}{
+		{name: "", want: nil},
+		{name: "base", want: []string{"base"}},
+		{name: "api", want: []string{"api", "web", "base"}},
+		{name: "loop", err: "template cycle: loop -> cycle -> loop"},
+		{name: "dangles", err: `extends undefined template "missing"`},
+		{name: "missing", err: `extends undefined template "missing"`},
+	}
+	for _, tt := range tests {
+		chain, err := cfg.templateChain(tt.name)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("templateChain(%q) error = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("templateChain(%q) error = %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, tmpl := range chain {
+			got = append(got, tmpl.Command)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("templateChain(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
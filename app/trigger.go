@@ -0,0 +1,111 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxChainDepth is the number of runs a chain of triggered runs is limited to,
+// it stops tasks triggering each other forever
+const maxChainDepth = 100
+
+// chainTasks makes the exits of the runs of the tasks of the workspace trigger
+// the tasks they declare in on_success, on_failure and on_exit
+func (lenc *Lencak) chainTasks(ws *Workspace) {
+	for _, t := range ws.Tasks {
+		t.activeMu.Lock()
+		t.exited = func(t *Task) func(*TaskRun) {
+			return func(run *TaskRun) {
+				lenc.triggerTasks(ws.Name, t, run)
+			}
+		}(t)
+		t.activeMu.Unlock()
+	}
+}
+
+// triggerTasks starts the tasks triggered by the exit of the run of the task t.
+// The triggered runs carry the correlation of the run, the run starts a chain
+// when it has none. A run stopped by lencak triggers nothing.
+func (lenc *Lencak) triggerTasks(workSpaceName string, t *Task, run *TaskRun) {
+	names := append([]string{}, t.Config.OnExit...)
+	if runError(run) == nil {
+		names = append(names, t.Config.OnSuccess...)
+	} else {
+		names = append(names, t.Config.OnFailure...)
+	}
+	if len(names) == 0 || run.isStopRequested() {
+		return
+	}
+	ws, err := lenc.workspace(workSpaceName)
+	if err != nil {
+		return
+	}
+	if run.depth >= maxChainDepth {
+		log.Warnf("chain %s of workspace %s reached %d runs, not triggering %s", run.Correlation, ws.Name, maxChainDepth, strings.Join(names, ", "))
+		ws.AddEvent("Chain %s stopped after %d runs", run.Correlation, maxChainDepth)
+		return
+	}
+
+	if run.Correlation == "" {
+		run.Correlation = fmt.Sprintf("%s-%d", t.Name, run.Id)
+	}
+	opts := &RunOptions{
+		correlation: run.Correlation,
+		triggeredBy: fmt.Sprintf("the exit of %s run %d", t.Name, run.Id),
+		depth:       run.depth + 1,
+		outputs:     run.Outputs,
+	}
+	for _, name := range names {
+		err := lenc.withUnlockedTask(ws.Name, name, "trigger", func(task *Task) error {
+			runs, _, err := task.startInstances(lenc.sync, opts)
+			if err == nil && len(runs) == 0 {
+				err = fmt.Errorf("task %s is already running", name)
+			}
+			return err
+		})
+		if err != nil {
+			log.Warnf("task %s not triggered by %s: %v", name, opts.triggeredBy, err)
+			ws.AddEvent("Task %s not triggered by %s: %v", name, opts.triggeredBy, err)
+			continue
+		}
+		ws.AddEvent("Task %s triggered by %s", name, opts.triggeredBy)
+	}
+	lenc.notify()
+}
+
+// CorrelatedRun is a run of a chain of triggered runs with its task
+type CorrelatedRun struct {
+	Task string   `json:"task"`
+	Run  *TaskRun `json:"run"`
+}
+
+// CorrelatedRuns returns the runs of the chain correlation of the workspace
+// workSpaceName in the order they started
+func (lenc *Lencak) CorrelatedRuns(workSpaceName, correlation string) ([]*CorrelatedRun, error) {
+	ws, err := lenc.workspace(workSpaceName)
+	if err != nil {
+		return nil, err
+	}
+	var runs []*CorrelatedRun
+	lenc.mu.RLock()
+	for _, t := range ws.Tasks {
+		t.activeMu.Lock()
+		for _, run := range t.TaskRuns {
+			if run.Correlation == correlation {
+				runs = append(runs, &CorrelatedRun{Task: t.Name, Run: run})
+			}
+		}
+		t.activeMu.Unlock()
+	}
+	lenc.mu.RUnlock()
+	if len(runs) == 0 {
+		return nil, notFound("chain %s not found in workspace %s", correlation, workSpaceName)
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Run.Started.Before(runs[j].Run.Started)
+	})
+	return runs, nil
+}
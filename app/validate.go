@@ -0,0 +1,569 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigError is an error found in a workspace file. A warning reports a
+// problem lencak runs with, e.g a missing working directory fails the runs of
+// the task but not the load of the configuration.
+type ConfigError struct {
+	File    string
+	Line    int
+	Task    string
+	Message string
+	Warning bool
+}
+
+func (e *ConfigError) Error() string {
+	if e.Warning {
+		return "warning: " + e.text()
+	}
+	return e.text()
+}
+
+// text returns the error without the warning prefix, used when the warning is
+// logged at the warning level
+func (e *ConfigError) text() string {
+	var b strings.Builder
+	b.WriteString(e.File)
+	if e.Line > 0 {
+		b.WriteString(":" + strconv.Itoa(e.Line))
+	}
+	b.WriteString(": ")
+	if e.Task != "" {
+		fmt.Fprintf(&b, "task %q: ", e.Task)
+	}
+	b.WriteString(e.Message)
+	return b.String()
+}
+
+// ValidationErrors is the list of errors found in the configuration
+type ValidationErrors []error
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// split returns the errors of the list and its warnings
+func (errs ValidationErrors) split() (errors, warnings ValidationErrors) {
+	for _, err := range errs {
+		if cerr, ok := err.(*ConfigError); ok && cerr.Warning {
+			warnings = append(warnings, err)
+		} else {
+			errors = append(errors, err)
+		}
+	}
+	return errors, warnings
+}
+
+var yamlLineRe = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// parseErrors converts the error returned by the yaml decoder of file into
+// ConfigErrors carrying the line of each error
+func parseErrors(file string, err error) error {
+	var msgs []string
+	if te, ok := err.(*yaml.TypeError); ok {
+		msgs = te.Errors
+	} else {
+		msgs = []string{err.Error()}
+	}
+
+	errs := make(ValidationErrors, 0, len(msgs))
+	for _, msg := range msgs {
+		cerr := &ConfigError{File: file, Message: strings.TrimPrefix(msg, "yaml: ")}
+		if m := yamlLineRe.FindStringSubmatch(msg); m != nil {
+			cerr.Line, _ = strconv.Atoi(m[1])
+			cerr.Message = m[2]
+		}
+		errs = append(errs, cerr)
+	}
+	return errs
+}
+
+// builtinVars are the variables lencak defines for every task run
+var builtinVars = []string{"USER", "UID", "GID", "HOME", "TASK", "RUN", "PWD", "WORKSPACE", "INSTANCE", "LENCAK_OUTPUT"}
+
+var varRe = regexp.MustCompile(`\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+var varNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Validate checks the semantic of the workspace configuration: task names must be
+// unique, commands must not be empty, working directories must exist, executors
+// must be found in PATH, the variables used by a task must be defined and the
+// dependencies of tasks, the groups of columns and the profiles must refer to
+// declared tasks. A port can be pinned by a single task. Undefined variables,
+// missing working directories and executors are reported as warnings, as the
+// deprecated keys found while parsing the files.
+func (cfg *ConfigWorkspace) Validate() ValidationErrors {
+	errs := append(ValidationErrors(nil), cfg.warnings...)
+	report := func(warning bool, t *ConfigTask, format string, args ...interface{}) {
+		cerr := &ConfigError{File: cfg.file, Message: fmt.Sprintf(format, args...), Warning: warning}
+		if t != nil {
+			cerr.File = t.file
+			cerr.Task = t.Name
+			cerr.Line = t.line
+		}
+		errs = append(errs, cerr)
+	}
+	fail := func(t *ConfigTask, format string, args ...interface{}) {
+		report(false, t, format, args...)
+	}
+	warn := func(t *ConfigTask, format string, args ...interface{}) {
+		report(true, t, format, args...)
+	}
+
+	if strings.TrimSpace(cfg.Name) == "" {
+		fail(nil, "workspace name is required")
+	}
+
+	for name, fn := range cfg.Functions {
+		if fn == nil || strings.TrimSpace(fn.Command) == "" {
+			fail(nil, "function %q: missing commands", name)
+			continue
+		}
+		if err := validateExecutor(fn.Executor); err != nil {
+			fail(nil, "function %q: %v", name, err)
+		} else if err := lookExecutor(fn.Executor); err != nil {
+			warn(nil, "function %q: %v", name, err)
+		}
+		for _, arg := range fn.Args {
+			if !varNameRe.MatchString(arg) {
+				fail(nil, "function %q: invalid argument name %q", name, arg)
+			}
+		}
+		if len(fn.Executor) == 0 {
+			env := cfg.knownVars(&ConfigTask{})
+			for _, arg := range fn.Args {
+				env[arg] = "$" + arg
+			}
+			for _, v := range undefinedVars(fn.Command, env) {
+				warn(nil, "function %q: undefined variable $%s in commands", name, v)
+			}
+		}
+	}
+
+	seen := make(map[string]*ConfigTask)
+	pinned := make(map[int]string)
+	for i, t := range cfg.Tasks {
+		if t == nil {
+			fail(nil, "task #%d is empty", i+1)
+			continue
+		}
+		if strings.TrimSpace(t.Name) == "" {
+			fail(t, "task #%d has no name", i+1)
+		} else if first, ok := seen[t.Name]; ok {
+			fail(t, "duplicate task name, first declared at %s:%d", first.file, first.line)
+		} else {
+			seen[t.Name] = t
+		}
+
+		if strings.TrimSpace(t.Command) == "" {
+			fail(t, "missing command")
+		}
+		if err := validateExecutor(t.Executor); err != nil {
+			fail(t, "%v", err)
+		} else if err := lookExecutor(t.Executor); err != nil {
+			warn(t, "%v", err)
+		}
+
+		params := make(map[string]bool)
+		for _, param := range t.Parameters {
+			switch {
+			case param == nil:
+				fail(t, "empty parameter")
+			case !varNameRe.MatchString(param.Name):
+				fail(t, "invalid parameter name %q", param.Name)
+			case params[param.Name]:
+				fail(t, "duplicate parameter %q", param.Name)
+			default:
+				params[param.Name] = true
+				if param.Required && param.Default != "" {
+					fail(t, "parameter %q is required and has a default", param.Name)
+				}
+				if param.Required && t.Service {
+					fail(t, "parameter %q is required, a service starts without parameters", param.Name)
+				}
+			}
+		}
+
+		if t.ReloadSignal != "" {
+			if _, ok := signals[strings.ToLower(t.ReloadSignal)]; !ok {
+				fail(t, "unknown reload_signal %q", t.ReloadSignal)
+			}
+			if t.ReloadCommand != "" {
+				fail(t, "reload_signal and reload_command are exclusive")
+			}
+		}
+
+		if t.Replicas < 0 {
+			fail(t, "replicas must be at least 1")
+		}
+		if t.Retries < 0 {
+			fail(t, "retries must be positive")
+		}
+		if t.Retries > 0 && t.Service {
+			fail(t, "retries with service, a service is restarted when it exits")
+		}
+		if (len(t.RetryOn) > 0 || t.RetryBackoff != "") && t.Retries == 0 {
+			fail(t, "retry_on and retry_backoff need retries")
+		}
+		for _, status := range t.RetryOn {
+			if status < 1 || status > 255 {
+				fail(t, "invalid exit status %d in retry_on", status)
+			}
+		}
+		if t.RetryBackoff != "" {
+			if _, err := time.ParseDuration(t.RetryBackoff); err != nil {
+				fail(t, "invalid retry_backoff %q", t.RetryBackoff)
+			}
+		}
+		for _, name := range sortedKeys(t.Ports) {
+			port := t.Ports[name]
+			switch {
+			case !varNameRe.MatchString(name):
+				fail(t, "invalid port variable name %q", name)
+			case port < 0 || port > 65535:
+				fail(t, "invalid port %d for $%s", port, name)
+			case port == 0:
+			case pinned[port] != "":
+				fail(t, "port %d of $%s is already pinned by task %q", port, name, pinned[port])
+			default:
+				pinned[port] = t.Name
+			}
+		}
+
+		for key := range t.Labels {
+			if !labelKeyRe.MatchString(key) {
+				fail(t, "invalid label %q", key)
+			}
+		}
+
+		env := cfg.knownVars(t)
+		fields := map[string]string{"pwd": t.Pwd, "stdout": t.Stdout, "stderr": t.Stderr}
+		// with an executor the command is interpreted by it, and it may define
+		// variables of its own
+		if len(t.Executor) == 0 {
+			fields["command"] = t.Command
+			for name, command := range t.hooks() {
+				fields[name] = command
+			}
+			fields["stop_command"] = t.StopCommand
+			fields["reload_command"] = t.ReloadCommand
+		}
+		for _, field := range []string{"command", "pwd", "stdout", "stderr", "before_start", "after_start", "before_stop", "after_stop", "stop_command", "reload_command"} {
+			for _, v := range undefinedVars(fields[field], env) {
+				warn(t, "undefined variable $%s in %s", v, field)
+			}
+		}
+
+		if t.OnDemand {
+			if _, ok := env["PORT"]; !ok && len(t.Ports) == 0 {
+				fail(t, "on_demand without a port to proxy to")
+			}
+		}
+		for _, name := range sortedKeys(t.Sockets) {
+			if !socketNameRe.MatchString(name) {
+				fail(t, "invalid socket name %q", name)
+			}
+			if strings.TrimSpace(t.Sockets[name]) == "" {
+				fail(t, "socket %q has no address", name)
+			}
+			for _, v := range undefinedVars(t.Sockets[name], env) {
+				warn(t, "undefined variable $%s in socket %q", v, name)
+			}
+		}
+		if w := t.Watch; w != nil {
+			if len(w.Paths) == 0 {
+				fail(t, "watch without paths")
+			}
+			for _, glob := range append(append([]string{}, w.Include...), w.Exclude...) {
+				if _, err := filepath.Match(glob, ""); err != nil {
+					fail(t, "invalid watch glob %q", glob)
+				}
+			}
+			if w.Debounce != "" {
+				if d, err := time.ParseDuration(w.Debounce); err != nil || d <= 0 {
+					fail(t, "invalid watch debounce %q", w.Debounce)
+				}
+			}
+		}
+		if t.HookTimeout != "" {
+			if d, err := time.ParseDuration(t.HookTimeout); err != nil || d <= 0 {
+				fail(t, "invalid hook_timeout %q", t.HookTimeout)
+			}
+		}
+		if t.IdleTimeout != "" {
+			if !t.OnDemand {
+				fail(t, "idle_timeout without on_demand")
+			} else if d, err := time.ParseDuration(t.IdleTimeout); err != nil || d <= 0 {
+				fail(t, "invalid idle_timeout %q", t.IdleTimeout)
+			}
+		}
+
+		if t.PortOffset != 0 {
+			if port, ok := env["PORT"]; !ok {
+				fail(t, "port_offset without $PORT")
+			} else if _, err := strconv.Atoi(port); err != nil && !strings.Contains(port, "$") {
+				fail(t, "port_offset with a non numeric $PORT %q", port)
+			}
+		}
+
+		if t.Pwd != "" {
+			pwd := ReplaceVars(t.Pwd, env)
+			if !strings.Contains(pwd, "$") {
+				if fi, err := os.Stat(pwd); err != nil {
+					warn(t, "pwd %s does not exist", pwd)
+				} else if !fi.IsDir() {
+					warn(t, "pwd %s is not a directory", pwd)
+				}
+			}
+		}
+	}
+
+	for _, t := range cfg.Tasks {
+		if t == nil {
+			continue
+		}
+		for _, dep := range t.DependsOn {
+			if dep == t.Name {
+				fail(t, "depends on itself")
+			} else if _, ok := seen[dep]; !ok {
+				fail(t, "depends on undefined task %q", dep)
+			}
+		}
+		triggers := map[string][]string{"on_success": t.OnSuccess, "on_failure": t.OnFailure, "on_exit": t.OnExit}
+		for _, field := range []string{"on_success", "on_failure", "on_exit"} {
+			for _, name := range triggers[field] {
+				if _, ok := seen[name]; !ok {
+					fail(t, "%s triggers undefined task %q", field, name)
+				}
+			}
+		}
+	}
+	for _, cycle := range dependencyCycles(seen) {
+		fail(seen[cycle[0]], "dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+
+	groups := make(map[string]string)
+	for _, column := range sortedKeys(cfg.Columns) {
+		for _, group := range sortedKeys(cfg.Columns[column]) {
+			if other, ok := groups[group]; ok {
+				fail(nil, "column %q: group %q already declared in column %q", column, group, other)
+			}
+			groups[group] = column
+			for _, name := range cfg.Columns[column][group] {
+				if _, ok := seen[name]; !ok {
+					fail(nil, "column %q: group %q refers to undefined task %q", column, group, name)
+				}
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(cfg.Pipelines) {
+		pipeline := cfg.Pipelines[name]
+		if pipeline == nil || len(pipeline.Stages) == 0 {
+			fail(nil, "pipeline %q has no stages", name)
+			continue
+		}
+		stages := make(map[string]bool)
+		for i, stage := range pipeline.Stages {
+			if stage == nil || len(stage.Tasks) == 0 {
+				fail(nil, "pipeline %q: stage %d has no tasks", name, i+1)
+				continue
+			}
+			if stages[stage.stageName(i)] {
+				fail(nil, "pipeline %q: duplicate stage %q", name, stage.stageName(i))
+			}
+			stages[stage.stageName(i)] = true
+			for _, task := range stage.Tasks {
+				if _, ok := seen[task]; !ok {
+					fail(nil, "pipeline %q: stage %q refers to undefined task %q", name, stage.stageName(i), task)
+				}
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(cfg.Profiles) {
+		profile := cfg.Profiles[name]
+		if profile == nil {
+			fail(nil, "profile %q is empty", name)
+			continue
+		}
+		for _, task := range profile.Tasks {
+			if _, ok := seen[task]; !ok {
+				fail(nil, "profile %q refers to undefined task %q", name, task)
+			}
+		}
+		for _, k := range sortedKeys(profile.Environment) {
+			if !varNameRe.MatchString(k) {
+				fail(nil, "profile %q: invalid environment variable name %q", name, k)
+			}
+		}
+	}
+
+	return errs
+}
+
+// dependencyCycles returns the cycles formed by the dependencies of tasks, each
+// cycle starts and ends with the same task
+func dependencyCycles(tasks map[string]*ConfigTask) [][]string {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var cycles [][]string
+	var path []string
+
+	var visit func(name string)
+	visit = func(name string) {
+		switch state[name] {
+		case visited:
+			return
+		case visiting:
+			for i, n := range path {
+				if n == name {
+					cycle := append([]string{}, path[i:]...)
+					cycles = append(cycles, append(cycle, name))
+					break
+				}
+			}
+			return
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range tasks[name].DependsOn {
+			if _, ok := tasks[dep]; ok && dep != name {
+				visit(dep)
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+	}
+
+	for _, name := range sortedKeys(tasks) {
+		visit(name)
+	}
+	return cycles
+}
+
+// knownVars returns the variables defined when t runs, variables only known at
+// run time are mapped to themselves
+func (cfg *ConfigWorkspace) knownVars(t *ConfigTask) map[string]string {
+	env := make(map[string]string)
+	if cfg.InheritEnvironment {
+		for _, kv := range os.Environ() {
+			p := strings.SplitN(kv, "=", 2)
+			if len(p) == 2 {
+				env[p[0]] = p[1]
+			}
+		}
+	}
+	for k, v := range cfg.Environment {
+		env[k] = v
+	}
+	for k, v := range t.Environment {
+		env[k] = v
+	}
+	for _, param := range t.Parameters {
+		if param != nil {
+			env[param.Name] = "$" + param.Name
+		}
+	}
+	// ports are allocated at run time
+	for name := range t.Ports {
+		env[name] = "$" + name
+	}
+	for _, other := range cfg.Tasks {
+		if other == nil {
+			continue
+		}
+		for name := range other.Ports {
+			v := portVar(other.Name, name)
+			env[v] = "$" + v
+		}
+	}
+	env = AddDefaultVars(env)
+	if _, ok := env["TASK"]; !ok {
+		env["TASK"] = t.Name
+	}
+	if _, ok := env["WORKSPACE"]; !ok {
+		env["WORKSPACE"] = cfg.Name
+	}
+	for _, k := range builtinVars {
+		if _, ok := env[k]; !ok {
+			env[k] = "$" + k
+		}
+	}
+	return env
+}
+
+// undefinedVars returns the variables referenced in text that are not defined in env
+func undefinedVars(text string, env map[string]string) []string {
+	var undefined []string
+	for _, m := range varRe.FindAllStringSubmatch(text, -1) {
+		if _, ok := env[m[1]]; !ok && !containsString(undefined, m[1]) {
+			undefined = append(undefined, m[1])
+		}
+	}
+	return undefined
+}
+
+func validateExecutor(executor []string) error {
+	if len(executor) == 0 {
+		return nil
+	}
+	for _, arg := range executor {
+		if strings.TrimSpace(arg) == "" {
+			return fmt.Errorf("invalid executor %q: empty argument", executor)
+		}
+	}
+	return nil
+}
+
+// lookExecutor checks the program of a valid executor is found in PATH
+func lookExecutor(executor []string) error {
+	if len(executor) == 0 {
+		return nil
+	}
+	if _, err := exec.LookPath(executor[0]); err != nil {
+		return fmt.Errorf("executor %q: %s not found", executor, executor[0])
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys of m, a map with string keys, sorted
+func sortedKeys(m interface{}) []string {
+	v := reflect.ValueOf(m)
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,232 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultDebounce is the time a watch waits for more changes before it triggers
+// its task when the task doesn't set one
+const defaultDebounce = 500 * time.Millisecond
+
+// fileWatcher reports the files changed under a set of paths, a directory is
+// watched recursively
+type fileWatcher interface {
+	// Changes returns the channel the changed files are sent on
+	Changes() <-chan string
+	Close()
+}
+
+// pollWatcher is a fileWatcher comparing the modification times of the files
+// every interval, it's used when inotify isn't available
+type pollWatcher struct {
+	paths   []string
+	changes chan string
+	done    chan struct{}
+}
+
+func newPollWatcher(paths []string, interval time.Duration) *pollWatcher {
+	w := &pollWatcher{
+		paths:   paths,
+		changes: make(chan string, 100),
+		done:    make(chan struct{}),
+	}
+	go w.run(interval)
+	return w
+}
+
+func (w *pollWatcher) Changes() <-chan string {
+	return w.changes
+}
+
+func (w *pollWatcher) Close() {
+	close(w.done)
+}
+
+func (w *pollWatcher) run(interval time.Duration) {
+	last := w.scan()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+		current := w.scan()
+		var changed []string
+		for path, mtime := range current {
+			if prev, ok := last[path]; !ok || !prev.Equal(mtime) {
+				changed = append(changed, path)
+			}
+		}
+		for path := range last {
+			if _, ok := current[path]; !ok {
+				changed = append(changed, path)
+			}
+		}
+		last = current
+
+		for _, path := range changed {
+			select {
+			case w.changes <- path:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// scan returns the modification time of every file under the paths
+func (w *pollWatcher) scan() map[string]time.Time {
+	times := make(map[string]time.Time)
+	for _, root := range w.paths {
+		filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				times[path] = fi.ModTime()
+			}
+			return nil
+		})
+	}
+	return times
+}
+
+// watchPaths returns the paths watched for the task, relative paths are relative
+// to the working directory of the task
+func (t *Task) watchPaths() []string {
+	paths := make([]string, len(t.Config.Watch.Paths))
+	for i, p := range t.Config.Watch.Paths {
+		p = ReplaceVars(p, t.Environment)
+		if !filepath.IsAbs(p) && t.Pwd != "" {
+			p = filepath.Join(t.Pwd, p)
+		}
+		paths[i] = filepath.Clean(p)
+	}
+	return paths
+}
+
+// watchMatches returns true when the changed file path triggers the task: it
+// must match an include glob, when the watch has some, and no exclude glob. A
+// glob matches the name of the file, the path relative to a watched path or any
+// directory of that path.
+func (t *Task) watchMatches(path string, roots []string) bool {
+	match := func(globs []string) bool {
+		for _, root := range roots {
+			rel, err := filepath.Rel(root, path)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			for _, glob := range globs {
+				if ok, _ := filepath.Match(glob, filepath.Base(path)); ok {
+					return true
+				}
+				if ok, _ := filepath.Match(glob, rel); ok {
+					return true
+				}
+				for _, dir := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+					if ok, _ := filepath.Match(glob, dir); ok && dir != "." {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	watch := t.Config.Watch
+	if len(watch.Include) > 0 && !match(watch.Include) {
+		return false
+	}
+	return !match(watch.Exclude)
+}
+
+// debounce returns the time the watch of the task waits for more changes
+func (t *Task) debounce() time.Duration {
+	if d, err := time.ParseDuration(t.Config.Watch.Debounce); err == nil && d > 0 {
+		return d
+	}
+	return defaultDebounce
+}
+
+// watchTasks starts watching the files of the tasks of the workspace declaring a
+// watch, unless they are already watched
+func (lenc *Lencak) watchTasks(ws *Workspace) {
+	for _, t := range ws.Tasks {
+		if t.Config.Watch == nil || len(t.Config.Watch.Paths) == 0 {
+			continue
+		}
+		t.watchMu.Lock()
+		if t.unwatchCh == nil {
+			t.unwatchCh = make(chan struct{})
+			go lenc.watch(ws, t, t.unwatchCh)
+		}
+		t.watchMu.Unlock()
+	}
+}
+
+// unwatch stops watching the files of the task
+func (t *Task) unwatch() {
+	t.watchMu.Lock()
+	defer t.watchMu.Unlock()
+	if t.unwatchCh != nil {
+		close(t.unwatchCh)
+		t.unwatchCh = nil
+	}
+}
+
+// watch triggers the task once its files stopped changing for the debounce of
+// the watch, until done is closed
+func (lenc *Lencak) watch(ws *Workspace, t *Task, done chan struct{}) {
+	roots := t.watchPaths()
+	w := newFileWatcher(roots)
+	defer w.Close()
+
+	changed := make(map[string]bool)
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case path := <-w.Changes():
+			if !t.watchMatches(path, roots) {
+				continue
+			}
+			changed[path] = true
+			timer = time.After(t.debounce())
+		case <-timer:
+			files := make([]string, 0, len(changed))
+			for path := range changed {
+				files = append(files, path)
+			}
+			sort.Strings(files)
+			changed = make(map[string]bool)
+			timer = nil
+			lenc.triggerWatch(ws, t, files)
+		}
+	}
+}
+
+// triggerWatch restarts the task after its files changed: a running service is
+// restarted, any other task is run again. Nothing is done while the workspace is
+// locked.
+func (lenc *Lencak) triggerWatch(ws *Workspace, t *Task, files []string) {
+	log.Infof("files of task %s changed: %s", t.Name, strings.Join(files, ", "))
+	// a service stopped from the ui stays stopped
+	if t.Config.Service && !t.Running() {
+		return
+	}
+	if _, err := lenc.unlockedWorkspace(ws.Name, "restart "+t.Name+" after a change"); err != nil {
+		return
+	}
+
+	opts := t.activeOptions()
+	opts.changedFiles = files
+	if err := t.Restart(lenc.sync, opts); err != nil {
+		ws.AddEvent("Unable to restart %s after a change: %v", t.Name, err)
+	}
+	lenc.notify()
+}
@@ -0,0 +1,145 @@
+//go:build linux
+// +build linux
+
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const inotifyMask = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE |
+	unix.IN_MODIFY | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ATTRIB
+
+// inotifyWatcher is a fileWatcher using inotify, every directory under the
+// watched paths is watched
+type inotifyWatcher struct {
+	fd      int
+	dirs    map[int32]string
+	changes chan string
+	done    chan struct{}
+}
+
+// newFileWatcher returns an inotify watcher of paths, a polling one when
+// inotify fails, e.g when the limit of watches is reached, or when a path
+// doesn't exist yet: inotify can't watch it
+func newFileWatcher(paths []string) fileWatcher {
+	for _, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			log.Warnf("%s doesn't exist, polling %s", path, strings.Join(paths, ", "))
+			return newPollWatcher(paths, time.Second)
+		}
+	}
+	w, err := newInotifyWatcher(paths)
+	if err != nil {
+		log.Warnf("inotify unavailable, polling %s: %v", strings.Join(paths, ", "), err)
+		return newPollWatcher(paths, time.Second)
+	}
+	return w
+}
+
+func newInotifyWatcher(paths []string) (*inotifyWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatcher{
+		fd:      fd,
+		dirs:    make(map[int32]string),
+		changes: make(chan string, 100),
+		done:    make(chan struct{}),
+	}
+	for _, path := range paths {
+		if err := w.add(path); err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+// add watches path, a directory is watched with every directory under it
+func (w *inotifyWatcher) add(path string) error {
+	return filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// the path may not exist yet or was removed meanwhile
+			return nil
+		}
+		if !fi.IsDir() && p != path {
+			return nil
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, p, inotifyMask)
+		if err != nil {
+			return err
+		}
+		w.dirs[int32(wd)] = p
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) Changes() <-chan string {
+	return w.changes
+}
+
+func (w *inotifyWatcher) Close() {
+	close(w.done)
+}
+
+func (w *inotifyWatcher) run() {
+	defer unix.Close(w.fd)
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	fds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+		// wake up regularly to notice Close
+		if n, err := unix.Poll(fds, 500); err != nil || n == 0 {
+			continue
+		}
+		n, err := unix.Read(w.fd, buf)
+		if err != nil || n < unix.SizeofInotifyEvent {
+			continue
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(ev.Len)]), "\x00")
+			offset = nameStart + int(ev.Len)
+
+			dir, ok := w.dirs[ev.Wd]
+			if !ok {
+				continue
+			}
+			if ev.Mask&unix.IN_IGNORED != 0 {
+				delete(w.dirs, ev.Wd)
+				continue
+			}
+			path := dir
+			if name != "" {
+				path = filepath.Join(dir, name)
+			}
+			if ev.Mask&unix.IN_ISDIR != 0 {
+				if ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+					w.add(path)
+				}
+				continue
+			}
+			select {
+			case w.changes <- path:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
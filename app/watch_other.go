@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package app
+
+import "time"
+
+// newFileWatcher returns a polling watcher of paths, inotify is only available
+// on linux
+func newFileWatcher(paths []string) fileWatcher {
+	return newPollWatcher(paths, time.Second)
+}
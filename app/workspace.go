@@ -2,8 +2,11 @@ package app
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -12,39 +15,85 @@ type Workspace struct {
 	Name               string
 	Environment        map[string]string
 	Tasks              map[string]*Task
-	IsLocked           bool
 	Functions          map[string]*Function
 	Columns            map[string]map[string][]string
 	InheritEnvironment bool
-	sync               chan bool
-}
+	Profiles           map[string]*Profile
+	Pipelines          map[string]*Pipeline
+	// the active profile, empty when none is
+	Profile string
+	sync    chan bool
+
+	// the configuration the workspace was built from
+	config *ConfigWorkspace
+
+	eventsMu sync.Mutex
+	Events   []*Event
+
+	lockMu sync.Mutex
+	lock   *Lock
 
-type Function struct {
-	Name     string   `json:"name"`
-	Args     []string `json:"args,omitempty"`
-	Command  string   `json:"command"`
-	Executor []string `json:"executor,omitempty"`
+	// the running operation on the tasks of the workspace, or the last one
+	operationMu sync.Mutex
+	operation   *OperationResult
 }
 
+// maxWorkspaceEvents is the number of events kept per workspace
+const maxWorkspaceEvents = 100
+
 func (ws *Workspace) MarshalJSON() ([]byte, error) {
+	ws.eventsMu.Lock()
+	events := make([]*Event, len(ws.Events))
+	copy(events, ws.Events)
+	ws.eventsMu.Unlock()
+	lock := ws.CurrentLock()
+	operation := ws.CurrentOperation()
+
 	return json.Marshal(&struct {
 		Name               string                         `json:"name,omitempty"`
 		Environment        map[string]string              `json:"environment,omitempty"`
 		Tasks              map[string]*Task               `json:"tasks"`
 		IsLocked           bool                           `json:"is_locked"`
+		Lock               *Lock                          `json:"lock,omitempty"`
 		Functions          map[string]*Function           `json:"function,omitempty"`
 		Columns            map[string]map[string][]string `json:"columns,omitempty"`
+		Profiles           map[string]*Profile            `json:"profiles,omitempty"`
+		Profile            string                         `json:"profile,omitempty"`
+		Pipelines          map[string]*Pipeline           `json:"pipelines,omitempty"`
 		InheritEnvironment bool                           `json:"inherit_environment"`
+		Events             []*Event                       `json:"events"`
+		Operation          *OperationResult               `json:"operation,omitempty"`
 	}{
 		Name:               ws.Name,
 		Environment:        ws.Environment,
 		Tasks:              ws.Tasks,
-		IsLocked:           ws.IsLocked,
+		IsLocked:           lock != nil,
+		Lock:               lock,
 		Functions:          ws.Functions,
+		Columns:            ws.Columns,
+		Profiles:           ws.Profiles,
+		Profile:            ws.Profile,
+		Pipelines:          ws.Pipelines,
 		InheritEnvironment: ws.InheritEnvironment,
+		Events:             events,
+		Operation:          operation,
 	})
 }
 
+// AddEvent records an event on the workspace, dropping the oldest one when the
+// workspace already holds maxWorkspaceEvents events
+func (ws *Workspace) AddEvent(format string, args ...interface{}) {
+	ev := &Event{time.Now(), fmt.Sprintf(format, args...)}
+	log.Infof("workspace %s: %s", ws.Name, ev.Message)
+
+	ws.eventsMu.Lock()
+	defer ws.eventsMu.Unlock()
+	if len(ws.Events) >= maxWorkspaceEvents {
+		ws.Events = ws.Events[1:]
+	}
+	ws.Events = append(ws.Events, ev)
+}
+
 // NewWorkspace returns a new workspace
 func NewWorkspace(sync chan bool, name string, environment map[string]string, columns map[string]map[string][]string, inheritEnv bool) *Workspace {
 	if environment == nil {
@@ -55,6 +104,7 @@ func NewWorkspace(sync chan bool, name string, environment map[string]string, co
 		Environment:        environment,
 		Tasks:              make(map[string]*Task),
 		Functions:          make(map[string]*Function),
+		Pipelines:          make(map[string]*Pipeline),
 		Columns:            columns,
 		InheritEnvironment: inheritEnv,
 		sync:               sync,
@@ -71,64 +121,79 @@ func configureWorkSpaces(syncChan chan bool, configWorkspaces map[string]*Config
 	for _, ws := range configWorkspaces {
 		log.Infof("=> Creating workspace: %s", ws.Name)
 
-		var workspace *Workspace
-		if wks, ok := workspaces[ws.Name]; ok {
-			log.Warnf("Workspace %s already exists, merging tasks and environment", ws.Name)
-			workspace = wks
-		} else {
-			workspace = NewWorkspace(syncChan, ws.Name, ws.Environment, ws.Columns, ws.InheritEnvironment)
-			workspaces[ws.Name] = workspace
-		}
+		workspaces[ws.Name] = newWorkspaceFromConfig(syncChan, ws, ws.profile)
+	}
+
+	return workspaces
+}
+
+// newWorkspaceFromConfig builds a workspace and its tasks from the configuration
+// with profile active, without starting any of them. The environment of the
+// profile is overlaid on the environment of every task.
+func newWorkspaceFromConfig(syncChan chan bool, ws *ConfigWorkspace, profile string) *Workspace {
+	workspace := NewWorkspace(syncChan, ws.Name, ws.Environment, ws.Columns, ws.InheritEnvironment)
+	workspace.config = ws
+	workspace.Profiles = make(map[string]*Profile)
+	for name, p := range ws.Profiles {
+		workspace.Profiles[name] = &Profile{Name: name, Tasks: p.Tasks, Environment: p.Environment}
+	}
+	var overlay map[string]string
+	if p, ok := workspace.Profiles[profile]; ok {
+		workspace.Profile = profile
+		overlay = p.Environment
+	}
 
-		if workspace.InheritEnvironment {
-			log.Info("=> Inheriting process environment into workspace")
-			for _, k := range os.Environ() {
-				p := strings.SplitN(k, "=", 2)
-				if strings.TrimSpace(p[0]) == "" {
-					log.Warn("Skipping empty environment key")
-					continue
-				}
-				log.Infof("  %s = %s", p[0], p[1])
-				// TODO variable subst for current env vars
-				if _, ok := workspace.Environment[p[0]]; !ok {
-					workspace.Environment[p[0]] = p[1]
-				}
+	if workspace.InheritEnvironment {
+		log.Info("=> Inheriting process environment into workspace")
+		for _, k := range os.Environ() {
+			p := strings.SplitN(k, "=", 2)
+			if strings.TrimSpace(p[0]) == "" {
+				log.Warn("Skipping empty environment key")
+				continue
+			}
+			log.Infof("  %s = %s", p[0], p[1])
+			// TODO variable subst for current env vars
+			if _, ok := workspace.Environment[p[0]]; !ok {
+				workspace.Environment[p[0]] = p[1]
 			}
 		}
+	}
 
-		for fn, args := range ws.Functions {
-			log.Infof("=> Creating workspace function: %s", fn)
-			workspace.Functions[fn] = &Function{
-				Name:     fn,
-				Args:     args.Args,
-				Command:  args.Command,
-				Executor: args.Executor,
-			}
+	for fn, args := range ws.Functions {
+		log.Infof("=> Creating workspace function: %s", fn)
+		workspace.Functions[fn] = &Function{
+			Name:     fn,
+			Args:     args.Args,
+			Command:  args.Command,
+			Executor: args.Executor,
+			Runs:     make([]*TaskRun, 0),
 		}
+	}
 
-		for _, t := range ws.Tasks {
-			log.Infof("=> Creating task: %s", t.Name)
+	for name, p := range ws.Pipelines {
+		workspace.Pipelines[name] = &Pipeline{Name: name, Stages: p.Stages}
+	}
 
-			if _, ok := workspace.Tasks[t.Name]; ok {
-				log.Warnf("Task %s already exists, overwriting", t.Name)
-			}
+	for _, t := range ws.Tasks {
+		log.Infof("=> Creating task: %s", t.Name)
 
-			env := make(map[string]string)
-			for k, v := range ws.Environment {
-				env[k] = v
-			}
-			for k, v := range t.Environment {
-				env[k] = v
-			}
+		if _, ok := workspace.Tasks[t.Name]; ok {
+			log.Warnf("Task %s already exists, overwriting", t.Name)
+		}
 
-			task := NewTask(t.Name, t.Executor, t.Command, env, t.Service, t.Stdout,
-				t.Stderr, t.KillSignal, t.Pwd)
-			if task.Service {
-				task.Start(syncChan)
-			}
-			workspace.Tasks[t.Name] = task
+		env := make(map[string]string)
+		for k, v := range workspace.Environment {
+			env[k] = v
 		}
+		for k, v := range t.Environment {
+			env[k] = v
+		}
+		for k, v := range overlay {
+			env[k] = v
+		}
+
+		workspace.Tasks[t.Name] = NewTask(t, env)
 	}
 
-	return workspaces
+	return workspace
 }
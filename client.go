@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/syaiful6/lencak/app"
+)
+
+// apiCommand sends msg to the command api of the lencak listening on addr and
+// decodes the result of the command into result
+func apiCommand(addr string, msg app.WSMessage, result interface{}) error {
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post("http://"+addr+"/api/command", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var response struct {
+		Error  string      `json:"error"`
+		Result interface{} `json:"result"`
+	}
+	response.Result = result
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("invalid response from lencak: %v", err)
+	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+// call calls a function of a running lencak with its arguments given as
+// name=value, prints the output of the run and returns its exit status
+func call(args []string) int {
+	fs := flag.NewFlagSet("call", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s call [-addr addr] [-detach] workspace function [name=value]...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	addr := ":9056"
+	fs.StringVar(&addr, "addr", addr, "Addr of the running lencak")
+	detach := false
+	fs.BoolVar(&detach, "detach", detach, "don't wait for the run to exit")
+	fs.Parse(args)
+
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return 2
+	}
+	arguments := make(map[string]string)
+	for _, arg := range fs.Args()[2:] {
+		p := strings.SplitN(arg, "=", 2)
+		if len(p) != 2 {
+			fmt.Fprintf(os.Stderr, "invalid argument %q, expected name=value\n", arg)
+			return 2
+		}
+		arguments[p[0]] = p[1]
+	}
+
+	var run struct {
+		Id         int    `json:"id"`
+		Error      string `json:"error"`
+		ExitStatus *int   `json:"exit_status"`
+		StdoutBuf  string `json:"stdoutbuf"`
+		StderrBuf  string `json:"stderrbuf"`
+	}
+	err := apiCommand(addr, app.WSMessage{
+		Command:   "call",
+		Workspace: fs.Arg(0),
+		Function:  fs.Arg(1),
+		Arguments: arguments,
+		Wait:      !detach,
+	}, &run)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if detach {
+		fmt.Printf("started run %d of %s\n", run.Id, fs.Arg(1))
+		return 0
+	}
+	fmt.Fprint(os.Stdout, run.StdoutBuf)
+	fmt.Fprint(os.Stderr, run.StderrBuf)
+	if run.Error != "" {
+		fmt.Fprintln(os.Stderr, run.Error)
+		return 1
+	}
+	if run.ExitStatus != nil {
+		return *run.ExitStatus
+	}
+	return 0
+}
+
+// lock locks a workspace of a running lencak, it returns the exit code of the command
+func lock(args []string) int {
+	fs := flag.NewFlagSet("lock", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s lock [-addr addr] [-owner owner] [-reason reason] [-ttl duration] workspace\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	addr := ":9056"
+	fs.StringVar(&addr, "addr", addr, "Addr of the running lencak")
+	owner := os.Getenv("USER")
+	fs.StringVar(&owner, "owner", owner, "owner of the lock")
+	reason := ""
+	fs.StringVar(&reason, "reason", reason, "why the workspace is locked")
+	ttl := ""
+	fs.StringVar(&ttl, "ttl", ttl, "release the lock after this duration, e.g 30m")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	var l app.Lock
+	err := apiCommand(addr, app.WSMessage{
+		Command:   "lock",
+		Workspace: fs.Arg(0),
+		Owner:     owner,
+		Reason:    reason,
+		TTL:       ttl,
+	}, &l)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("workspace %s %s\n", fs.Arg(0), &l)
+	return 0
+}
+
+// unlock releases the lock of a workspace of a running lencak, it returns the
+// exit code of the command
+func unlock(args []string) int {
+	fs := flag.NewFlagSet("unlock", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s unlock [-addr addr] [-owner owner] [-force] workspace\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	addr := ":9056"
+	fs.StringVar(&addr, "addr", addr, "Addr of the running lencak")
+	owner := os.Getenv("USER")
+	fs.StringVar(&owner, "owner", owner, "owner of the lock")
+	force := false
+	fs.BoolVar(&force, "force", force, "release a lock owned by someone else")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	err := apiCommand(addr, app.WSMessage{
+		Command:   "unlock",
+		Workspace: fs.Arg(0),
+		Owner:     owner,
+		Force:     force,
+	}, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("workspace %s unlocked\n", fs.Arg(0))
+	return 0
+}
@@ -4,32 +4,166 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 
 	"github.com/syaiful6/lencak/app"
 	"github.com/syaiful6/lencak/assets"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(validate(os.Args[2:]))
+		case "config":
+			os.Exit(printConfig(os.Args[2:]))
+		case "call":
+			os.Exit(call(os.Args[2:]))
+		case "lock":
+			os.Exit(lock(os.Args[2:]))
+		case "unlock":
+			os.Exit(unlock(os.Args[2:]))
+		}
+	}
+
 	addr := ":9056"
 	flag.StringVar(&addr, "addr", addr, "Addr for app to listen")
 
-	var workspaces []string
-	flag.Var((*app.AppendSliceValue)(&workspaces), "workspace", "lencak workspace file (can be specified multiple times), defaults to './workspace.yml'")
+	var workspaces, workspaceDirs []string
+	workspaceFlags(flag.CommandLine, &workspaces, &workspaceDirs)
+
+	var profiles []string
+	flag.Var((*app.AppendSliceValue)(&profiles), "profile", "activate the profile in every workspace declaring it, or in one workspace given as workspace/profile (can be specified multiple times)")
 
-	if len(workspaces) == 0 {
-		workspaces = append(workspaces, "workspace.yml")
+	watchConfig := false
+	flag.BoolVar(&watchConfig, "watch-config", watchConfig, "reload the configuration when a workspace file changes")
+	flag.Parse()
+
+	loadConfig := func() (map[string]*app.ConfigWorkspace, error) {
+		files, err := workspaceFiles(workspaces, workspaceDirs)
+		if err != nil {
+			return nil, err
+		}
+		config, err := app.LoadConfig(files)
+		if err != nil {
+			return nil, err
+		}
+		if err = app.SelectProfiles(config, profiles); err != nil {
+			return nil, err
+		}
+		return config, nil
 	}
-	config, err := app.LoadConfig(workspaces)
+	config, err := loadConfig()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
 		os.Exit(1)
 	}
 
 	appInstance := app.NewApp(config, assets.Asset)
+	appInstance.SetConfigLoader(loadConfig)
+	if watchConfig {
+		appInstance.WatchConfig(append(workspaces, workspaceDirs...), 2*time.Second)
+	}
 
 	if err = appInstance.ListenAndServe(addr); err != nil {
 		log.Fatalln(err)
 	}
 }
+
+// workspaceFlags defines the flags selecting the workspace files on fs
+func workspaceFlags(fs *flag.FlagSet, workspaces, workspaceDirs *[]string) {
+	fs.Var((*app.AppendSliceValue)(workspaces), "workspace", "lencak workspace file (can be specified multiple times), defaults to './workspace.yml'")
+	fs.Var((*app.AppendSliceValue)(workspaceDirs), "workspace-dir", "load every *.yml file in the directory (can be specified multiple times)")
+}
+
+// workspaceFiles returns the workspace files followed by the files found in
+// workspaceDirs, defaults to './workspace.yml' when none is given
+func workspaceFiles(workspaces, workspaceDirs []string) ([]string, error) {
+	files := append([]string{}, workspaces...)
+	for _, dir := range workspaceDirs {
+		found, err := app.WorkspaceFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, found...)
+	}
+
+	if len(workspaces) == 0 && len(workspaceDirs) == 0 {
+		files = append(files, "workspace.yml")
+	}
+	return files, nil
+}
+
+// subcommandFiles parses the arguments of a subcommand, the workspace files can
+// be given with the workspace flags or as arguments
+func subcommandFiles(name string, args []string) ([]string, error) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [-workspace file]... [-workspace-dir dir]... [file]...\n", os.Args[0], name)
+		fs.PrintDefaults()
+	}
+
+	var workspaces, workspaceDirs []string
+	workspaceFlags(fs, &workspaces, &workspaceDirs)
+	fs.Parse(args)
+
+	return workspaceFiles(append(workspaces, fs.Args()...), workspaceDirs)
+}
+
+// validate checks the workspace files and reports every error and warning found
+// in them, it returns the exit code of the command: non zero when any is found
+func validate(args []string) int {
+	files, err := subcommandFiles("validate", args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	log.SetLevel(log.WarnLevel)
+	warnings, err := app.CheckConfig(files)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(warnings) > 0 {
+		fmt.Fprintln(os.Stderr, warnings)
+		return 1
+	}
+	fmt.Printf("%s: ok\n", strings.Join(files, ", "))
+	return 0
+}
+
+// printConfig prints the effective configuration: the workspace files merged and
+// the defaults and templates applied to the tasks. It returns the exit code of
+// the command
+func printConfig(args []string) int {
+	files, err := subcommandFiles("config", args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	log.SetLevel(log.WarnLevel)
+	config, err := app.LoadConfig(files)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, cfg := range config {
+		cfg.Include = nil
+		cfg.Defaults = nil
+		cfg.Templates = nil
+	}
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Stdout.Write(out)
+	return 0
+}
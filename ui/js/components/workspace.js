@@ -1,7 +1,11 @@
 import m from 'mithril'
 import { Button, List, Dialog, ListTile, Icon, SVG, Toolbar, ToolbarTitle } from 'polythene-mithril';
 
-import {STOP_TASK, START_TASK} from '../constant';
+import {
+  STOP_TASK, START_TASK, RERUN_TASK, RELOAD_TASK, START_GROUP, STOP_GROUP,
+  START_WORKSPACE, STOP_WORKSPACE, RESTART_WORKSPACE, SWITCH_PROFILE,
+  START_PIPELINE, STOP_PIPELINE, RETRY_PIPELINE, LOCK_WORKSPACE, UNLOCK_WORKSPACE
+} from '../constant';
 
 function percentActive(active, total) {
   return (active / total) * 100
@@ -15,13 +19,13 @@ const workspacesIcons = [
 const TaskListTile = {
   view({ attrs }) {
     const {workspace, task, sender} = attrs;
-    const running = task.status === 'Running';
+    const running = task.running > 0;
     return m(ListTile, {
       style: {
         background: running ? '#E0FFE6' : '#FFF1F0'
       },
       title: task.name,
-      subtitle: task.command,
+      subtitle: task.replicas > 1 ? `${task.command} (${task.status})` : task.command,
       key: task.name,
       front: m(Icon, m(SVG, m.trust(workspacesIcons[1]))),
       hoverable: true,
@@ -41,10 +45,30 @@ const TaskListTile = {
       }, [
         m(ToolbarTitle, { text: task.name }),
       ]),
-      body: "Body",
+      body: [taskDetails(workspace, task), taskRuns(workspace, task, sender)],
       footerButtons: [
+        hasParameters(task) ? m(Button, {
+          label: 'Run with…',
+          disabled: workspace.is_locked || task.running > 0,
+          style: {
+            background: '#48B7C7',
+            color: '#fff'
+          },
+          events: {
+            onclick: () => {
+              const payload = promptRunOptions(task);
+              if (payload) {
+                sender({
+                  type: START_TASK,
+                  payload: Object.assign({ workspace: workspace.name, task: task.name }, payload)
+                });
+              }
+            }
+          }
+        }) : null,
         m(Button, {
           label: task.service ? 'Disable' : 'Enable',
+          disabled: workspace.is_locked,
           style: {
             background: task.service ? '#FF6559' : '#4DDD66',
             color: '#fff'
@@ -62,20 +86,37 @@ const TaskListTile = {
             }
           }
         }),
+        task.running > 0 ? m(Button, {
+          label: 'Reload',
+          disabled: workspace.is_locked,
+          style: {
+            background: '#48B7C7',
+            color: '#fff'
+          },
+          events: {
+            onclick: () => {
+              sender({
+                type: RELOAD_TASK,
+                payload: { workspace: workspace.name, task: task.name }
+              })
+            }
+          }
+        }) : null,
         m(Button, {
-          label: task.status === 'Running' ? 'Stop' : 'Restart',
+          label: task.running > 0 ? 'Stop' : 'Restart',
+          disabled: workspace.is_locked,
           style: {
-            background: task.status === 'Running' ? '#FF6559' : '#4DDD66',
+            background: task.running > 0 ? '#FF6559' : '#4DDD66',
             color: '#fff'
           },
           events: {
             onclick: () => {
               sender({
-                type: task.status === 'Running' ? STOP_TASK : START_TASK,
+                type: task.running > 0 ? STOP_TASK : START_TASK,
                 payload: {
                   workspace: workspace.name,
                   task: task.name,
-                  service: task.status === 'Running' && task.service ? false : task.service
+                  service: task.running > 0 && task.service ? false : task.service
                 }
               })
             }
@@ -86,23 +127,412 @@ const TaskListTile = {
   }
 }
 
+function hasParameters(task) {
+  return (task.parameters && task.parameters.length > 0) || task.extra_args;
+}
+
+// promptRunOptions asks the parameters and the extra arguments of a run of task,
+// it returns nothing when a prompt is cancelled
+function promptRunOptions(task) {
+  const parameters = {};
+  for (const param of task.parameters || []) {
+    const label = param.description ? `${param.name} (${param.description})` : param.name;
+    const value = window.prompt(label, param.default || '');
+    if (value === null) {
+      return;
+    }
+    if (value !== '' || param.required) {
+      parameters[param.name] = value;
+    }
+  }
+  let extraArgs = [];
+  if (task.extra_args) {
+    const args = window.prompt('Extra arguments', '');
+    if (args === null) {
+      return;
+    }
+    extraArgs = args.split(' ').filter(arg => arg !== '');
+  }
+  return { parameters, extraArgs };
+}
+
+function isURL(value) {
+  return /^https?:\/\//.test(value);
+}
+
+function taskDetails(workspace, task) {
+  const labels = task.labels || {};
+  const metadata = task.metadata || {};
+  const ports = task.ports || {};
+  return m('.task-details', [
+    m('p', m('code', task.command)),
+    Object.keys(ports).length === 0 ? null : m('p.task-ports', [
+      Object.keys(ports).sort().map(name => `$${name}=${ports[name]}`).join(' '),
+      ' ',
+      m('a', {
+        href: `/proxy/${workspace.name}/${task.name}/`,
+        target: '_blank',
+        rel: 'noopener noreferrer'
+      }, 'open')
+    ]),
+    Object.keys(labels).length === 0 ? null : m('.task-labels',
+      Object.keys(labels).sort().map(key =>
+        m('span', {
+          style: {
+            display: 'inline-block',
+            margin: '0 4px 4px 0',
+            padding: '2px 8px',
+            borderRadius: '12px',
+            background: '#E3F4F7'
+          }
+        }, `${key}=${labels[key]}`)
+      )
+    ),
+    Object.keys(metadata).length === 0 ? null : m('table.task-metadata',
+      Object.keys(metadata).sort().map(key =>
+        m('tr', [
+          m('th', { style: { textAlign: 'left', paddingRight: '12px' } }, key),
+          m('td', isURL(metadata[key])
+            ? m('a', { href: metadata[key], target: '_blank', rel: 'noopener noreferrer' }, metadata[key])
+            : metadata[key])
+        ])
+      )
+    )
+  ]);
+}
+
+function runDescription(task, run) {
+  let text = `#${run.id} started ${new Date(run.started).toLocaleString()}`;
+  if (task.replicas > 1) {
+    text += ` on instance ${run.instance}`;
+  }
+  if (run.rerun_of !== undefined) {
+    text += `, re-run of #${run.rerun_of}`;
+  }
+  if (run.retry_of !== undefined) {
+    text += `, attempt ${run.attempt} of #${run.retry_of}`;
+  }
+  if (run.changed_files) {
+    text += `, triggered by changes to ${run.changed_files.join(', ')}`;
+  }
+  if (run.triggered_by) {
+    text += `, triggered by ${run.triggered_by} (chain ${run.correlation})`;
+  }
+  if (run.error) {
+    return `${text}: ${run.error}`;
+  }
+  if (run.exit_status !== undefined) {
+    text += `, exited with status ${run.exit_status}`;
+  }
+  const params = Object.keys(run.arguments || {})
+    .map(k => `${k}=${run.arguments[k]}`)
+    .concat(run.extra_args || []);
+  return params.length > 0 ? `${text} (${params.join(' ')})` : text;
+}
+
+function taskRuns(workspace, task, sender) {
+  const runs = (task.runs || []).slice().reverse();
+  if (runs.length === 0) {
+    return null;
+  }
+  return m('.task-runs', [
+    m('h4', 'Recent runs'),
+    runs.map(run =>
+      m('div', { key: run.id }, [
+        m('span', runDescription(task, run)),
+        m(Button, {
+          label: 'Re-run',
+          disabled: workspace.is_locked || task.running > 0,
+          events: {
+            onclick: () => sender({
+              type: RERUN_TASK,
+              payload: { workspace: workspace.name, task: task.name, run: run.id }
+            })
+          }
+        })
+      ])
+    )
+  ]);
+}
+
+function lockDescription(lock) {
+  let text = `Locked by ${lock.owner}`;
+  if (lock.expires && lock.expires !== '0001-01-01T00:00:00Z') {
+    text += ` until ${new Date(lock.expires).toLocaleString()}`;
+  }
+  return lock.reason ? `${text}: ${lock.reason}` : text;
+}
+
+const LockButton = {
+  view({ attrs }) {
+    const {workspace, sender} = attrs;
+    return m(Button, {
+      label: workspace.is_locked ? 'Unlock' : 'Lock',
+      style: {
+        background: workspace.is_locked ? '#4DDD66' : '#FF6559',
+        color: '#fff'
+      },
+      events: {
+        onclick: () => {
+          if (workspace.is_locked) {
+            sender({
+              type: UNLOCK_WORKSPACE,
+              payload: { workspace: workspace.name, owner: workspace.lock.owner }
+            });
+            return;
+          }
+          const owner = window.prompt('Lock owner');
+          if (!owner) {
+            return;
+          }
+          sender({
+            type: LOCK_WORKSPACE,
+            payload: {
+              workspace: workspace.name,
+              owner,
+              reason: window.prompt('Reason') || '',
+              ttl: window.prompt('Expires after (e.g 30m, empty for never)') || ''
+            }
+          });
+        }
+      }
+    });
+  }
+}
+
+const GroupButton = {
+  view({ attrs }) {
+    const {workspace, group, start, sender} = attrs;
+    return m(Button, {
+      label: start ? 'Start' : 'Stop',
+      disabled: workspace.is_locked,
+      style: {
+        background: start ? '#4DDD66' : '#FF6559',
+        color: '#fff'
+      },
+      events: {
+        onclick: () => sender({
+          type: start ? START_GROUP : STOP_GROUP,
+          payload: { workspace: workspace.name, group }
+        })
+      }
+    });
+  }
+}
+
+function taskTiles(workspace, names, sender) {
+  return names
+    .filter(name => workspace.tasks[name])
+    .map(name => m(TaskListTile, { workspace, task: workspace.tasks[name], sender }));
+}
+
+// groupedTasks returns the groups of the columns of the workspace, the tasks
+// that are not part of any group are listed in a last column
+function groupedTasks(workspace) {
+  const columns = workspace.columns || {};
+  const grouped = {};
+  const result = Object.keys(columns).sort().map(column => ({
+    name: column,
+    groups: Object.keys(columns[column]).sort().map(group => {
+      columns[column][group].forEach(name => grouped[name] = true);
+      return { name: group, tasks: columns[column][group] };
+    })
+  }));
+
+  const ungrouped = Object.keys(workspace.tasks).filter(name => !grouped[name]);
+  if (ungrouped.length > 0) {
+    result.push({ name: '', groups: [{ name: '', tasks: ungrouped }] });
+  }
+  return result;
+}
+
+function groupHeader(workspace, group, tasks, sender) {
+  if (!group) {
+    return { title: 'Other tasks' };
+  }
+  const running = tasks.filter(name =>
+    workspace.tasks[name] && workspace.tasks[name].running > 0).length;
+  return {
+    title: `${group} (${running}/${tasks.length} running)`,
+    content: m('.workspace-group-actions', [
+      m(GroupButton, { workspace, group, start: true, sender }),
+      m(GroupButton, { workspace, group, start: false, sender }),
+    ])
+  };
+}
+
+const operationColors = {
+  pending: '#9E9E9E',
+  starting: '#48B7C7',
+  stopping: '#48B7C7',
+  ok: '#4DDD66',
+  failed: '#FF6559',
+  skipped: '#FFAB00',
+  running: '#48B7C7',
+  succeeded: '#4DDD66',
+  stopped: '#FFAB00'
+};
+
+const WorkspaceActions = {
+  view({ attrs }) {
+    const {workspace, sender} = attrs;
+    const busy = workspace.operation && !workspace.operation.done;
+    const action = (label, type, background) => m(Button, {
+      label,
+      disabled: workspace.is_locked || busy,
+      style: { background, color: '#fff' },
+      events: {
+        onclick: () => sender({ type, payload: { workspace: workspace.name } })
+      }
+    });
+    return m('.workspace-actions', [
+      action('Start all', START_WORKSPACE, '#4DDD66'),
+      action('Stop all', STOP_WORKSPACE, '#FF6559'),
+      action('Restart', RESTART_WORKSPACE, '#48B7C7'),
+    ]);
+  }
+}
+
+const ProfileSelect = {
+  view({ attrs }) {
+    const {workspace, sender} = attrs;
+    const profiles = Object.keys(workspace.profiles || {}).sort();
+    if (profiles.length === 0) {
+      return null;
+    }
+    const busy = workspace.operation && !workspace.operation.done;
+    return m('label.workspace-profile', [
+      'Profile ',
+      m('select', {
+        value: workspace.profile || '',
+        disabled: workspace.is_locked || busy,
+        onchange: (e) => sender({
+          type: SWITCH_PROFILE,
+          payload: { workspace: workspace.name, profile: e.target.value }
+        })
+      }, [m('option', { value: '' }, '(none)')].concat(
+        profiles.map(name => m('option', { value: name }, name))
+      ))
+    ]);
+  }
+}
+
+function operationSummary(operation) {
+  if (!operation.done) {
+    const finished = operation.tasks.filter(t =>
+      ['ok', 'failed', 'skipped'].indexOf(t.status) >= 0).length;
+    return `${operation.operation}: ${finished}/${operation.tasks.length} tasks`;
+  }
+  return `${operation.operation}: ${operation.success ? 'succeeded' : 'failed'}`;
+}
+
+const OperationProgress = {
+  view({ attrs }) {
+    const operation = attrs.operation;
+    if (!operation) {
+      return null;
+    }
+    return m('.workspace-operation', [
+      m('p', operationSummary(operation)),
+      operation.tasks.map(t =>
+        m('span', {
+          title: t.error || t.status,
+          style: {
+            display: 'inline-block',
+            margin: '0 4px 4px 0',
+            padding: '2px 8px',
+            borderRadius: '12px',
+            color: '#fff',
+            background: operationColors[t.status] || '#9E9E9E'
+          }
+        }, `${t.task}: ${t.status}`)
+      )
+    ]);
+  }
+}
+
+function statusChip(label, status, title) {
+  return m('span', {
+    title: title || status,
+    style: {
+      display: 'inline-block',
+      margin: '0 4px 4px 0',
+      padding: '2px 8px',
+      borderRadius: '12px',
+      color: '#fff',
+      background: operationColors[status] || '#9E9E9E'
+    }
+  }, label);
+}
+
+// Pipelines shows the stages of the last run of every pipeline of the workspace
+const Pipelines = {
+  view({ attrs }) {
+    const {workspace, sender} = attrs;
+    const names = Object.keys(workspace.pipelines || {}).sort();
+    if (names.length === 0) {
+      return null;
+    }
+    return m('.workspace-pipelines', names.map(name => {
+      const pipeline = workspace.pipelines[name];
+      const run = pipeline.runs.length > 0 ? pipeline.runs[pipeline.runs.length - 1] : null;
+      const running = pipeline.status === 'running';
+      const retryable = run && (run.status === 'failed' || run.status === 'stopped');
+      const action = (label, type, background, disabled) => m(Button, {
+        label,
+        disabled: workspace.is_locked || disabled,
+        style: { background, color: '#fff' },
+        events: {
+          onclick: () => sender({
+            type,
+            payload: { workspace: workspace.name, pipeline: name, run: run ? run.id : 0 }
+          })
+        }
+      });
+      return m('.workspace-pipeline', { key: name }, [
+        m('p', run ? `Pipeline ${name} #${run.id}: ${run.status}` : `Pipeline ${name}`),
+        (run ? run.stages : pipeline.stages.map((s, i) => ({ name: s.name || `stage ${i + 1}`, status: 'pending', tasks: [] })))
+          .map(stage => statusChip(stage.name, stage.status,
+            stage.tasks.map(t => `${t.task}: ${t.error || t.status}`).join('\n'))),
+        action(running ? 'Stop' : 'Start', running ? STOP_PIPELINE : START_PIPELINE, running ? '#FF6559' : '#4DDD66', false),
+        retryable ? action('Retry', RETRY_PIPELINE, '#48B7C7', false) : null,
+      ]);
+    }));
+  }
+}
+
 export default {
   view({ attrs }) {
     const workspace = attrs.workspace;
+    const sender = attrs.sender;
 
     return m('.workspace', [
-      m(List, {
-        header: {
-          title: workspace.name,
-        },
-        border: true,
-        tiles: Object.keys(workspace.tasks).map(key =>
-          m(TaskListTile, {
-            workspace, task: workspace.tasks[key],
-            sender: attrs.sender
-          })
-        ),
-      })
+      m('.workspace-lock', [
+        workspace.is_locked ? m('span', lockDescription(workspace.lock)) : null,
+        m(LockButton, { workspace, sender }),
+      ]),
+      m('h3', workspace.is_locked ? `${workspace.name} (locked)` : workspace.name),
+      m(WorkspaceActions, { workspace, sender }),
+      m(ProfileSelect, { workspace, sender }),
+      m(OperationProgress, { operation: workspace.operation }),
+      m(Pipelines, { workspace, sender }),
+      m('.workspace-columns', {
+        style: { display: 'flex', flexWrap: 'wrap', alignItems: 'flex-start' }
+      }, groupedTasks(workspace).map(column =>
+        m('.workspace-column', {
+          key: column.name,
+          style: { flex: '1 1 300px', margin: '0 8px 8px 0' }
+        }, [
+          column.name ? m('h4', column.name) : null,
+          column.groups.map(group =>
+            m(List, {
+              header: groupHeader(workspace, group.name, group.tasks, sender),
+              border: true,
+              tiles: taskTiles(workspace, group.tasks, sender),
+            })
+          )
+        ])
+      ))
     ])
   }
 }
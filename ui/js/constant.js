@@ -1,5 +1,19 @@
 export const START_TASK = 'START';
 export const STOP_TASK = 'STOP';
+export const RERUN_TASK = 'RERUN_TASK';
+export const RELOAD_TASK = 'RELOAD_TASK';
+export const START_GROUP = 'START_GROUP';
+export const STOP_GROUP = 'STOP_GROUP';
+export const START_WORKSPACE = 'START_WORKSPACE';
+export const STOP_WORKSPACE = 'STOP_WORKSPACE';
+export const RESTART_WORKSPACE = 'RESTART_WORKSPACE';
+export const SWITCH_PROFILE = 'SWITCH_PROFILE';
+export const START_PIPELINE = 'START_PIPELINE';
+export const STOP_PIPELINE = 'STOP_PIPELINE';
+export const RETRY_PIPELINE = 'RETRY_PIPELINE';
+export const RELOAD_CONFIG = 'RELOAD_CONFIG';
+export const LOCK_WORKSPACE = 'LOCK_WORKSPACE';
+export const UNLOCK_WORKSPACE = 'UNLOCK_WORKSPACE';
 export const CONNECTED = 'CONNECTED';
 export const DISCONNECTED = 'DISCONNECTED';
 export const WORKSPACE_REPLACE = 'WORKSPACE_REPLACE';
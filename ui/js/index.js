@@ -9,6 +9,7 @@ import { addToDocument } from './css/utils'
 import Workspace from './components/workspace'
 import NavigationList from "./components/navigation-list"
 import * as updater from './update';
+import { RELOAD_CONFIG } from './constant';
 
 
 const iconMenuSVG = "<svg width=\"24\" height=\"24\" viewBox=\"0 0 24 24\"><path d=\"M3 18h18v-2H3v2zm0-5h18v-2H3v2zm0-7v2h18V6H3z\"/></svg>";
@@ -39,9 +40,12 @@ const App = {
             }
           }),
           m(ToolbarTitle, { text: `Lencak: ${attrs.title}` }),
-          m(IconButton,
-            { icon: { svg: m.trust(iconRefreshSVG) } }
-          ),
+          m(IconButton, {
+            icon: { svg: m.trust(iconRefreshSVG) },
+            events: {
+              onclick: () => updater.send({ type: RELOAD_CONFIG })
+            }
+          }),
         ])
       ]),
       m(Dialog),
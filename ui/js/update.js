@@ -3,7 +3,10 @@ import stream from 'mithril/stream'
 
 import {createWebsocket} from './service/websocket';
 import {
-  START_TASK, STOP_TASK, CONNECTED, DISCONNECTED, WORKSPACE_REPLACE,
+  START_TASK, STOP_TASK, RERUN_TASK, RELOAD_TASK, START_GROUP, STOP_GROUP,
+  START_WORKSPACE, STOP_WORKSPACE, RESTART_WORKSPACE, SWITCH_PROFILE, RELOAD_CONFIG,
+  START_PIPELINE, STOP_PIPELINE, RETRY_PIPELINE, LOCK_WORKSPACE, UNLOCK_WORKSPACE,
+  CONNECTED, DISCONNECTED, WORKSPACE_REPLACE,
   SOCK_DISCONNECT, SOCK_CONNECTED
 } from './constant'
 
@@ -32,6 +35,8 @@ function update(model, msg) {
         workspace: msg.payload.workspace,
         task: msg.payload.task,
         service: typeof msg.payload.service !== 'boolean' ? false : msg.payload.service,
+        arguments: msg.payload.parameters,
+        extra_args: msg.payload.extraArgs,
         command: 'start'
       }));
       return Object.assign({}, model, {
@@ -53,6 +58,93 @@ function update(model, msg) {
         })
       });
 
+    case RERUN_TASK:
+      socket.send(JSON.stringify({
+        workspace: msg.payload.workspace,
+        task: msg.payload.task,
+        run: msg.payload.run,
+        command: 'rerun'
+      }));
+      return model;
+
+    case RELOAD_TASK:
+      socket.send(JSON.stringify({
+        workspace: msg.payload.workspace,
+        task: msg.payload.task,
+        command: 'reload_task'
+      }));
+      return model;
+
+    case START_GROUP:
+    case STOP_GROUP:
+      socket.send(JSON.stringify({
+        workspace: msg.payload.workspace,
+        group: msg.payload.group,
+        command: msg.type === START_GROUP ? 'start_group' : 'stop_group'
+      }));
+      return model;
+
+    case START_WORKSPACE:
+    case STOP_WORKSPACE:
+    case RESTART_WORKSPACE:
+      socket.send(JSON.stringify({
+        workspace: msg.payload.workspace,
+        command: {
+          [START_WORKSPACE]: 'start_workspace',
+          [STOP_WORKSPACE]: 'stop_workspace',
+          [RESTART_WORKSPACE]: 'restart_workspace'
+        }[msg.type]
+      }));
+      return model;
+
+    case SWITCH_PROFILE:
+      socket.send(JSON.stringify({
+        workspace: msg.payload.workspace,
+        profile: msg.payload.profile,
+        command: 'switch_profile'
+      }));
+      return model;
+
+    case START_PIPELINE:
+    case STOP_PIPELINE:
+    case RETRY_PIPELINE:
+      socket.send(JSON.stringify({
+        workspace: msg.payload.workspace,
+        pipeline: msg.payload.pipeline,
+        run: msg.payload.run,
+        command: {
+          [START_PIPELINE]: 'start_pipeline',
+          [STOP_PIPELINE]: 'stop_pipeline',
+          [RETRY_PIPELINE]: 'retry_pipeline'
+        }[msg.type]
+      }));
+      return model;
+
+    case RELOAD_CONFIG:
+      socket.send(JSON.stringify({
+        command: 'reload'
+      }));
+      return model;
+
+    case LOCK_WORKSPACE:
+      socket.send(JSON.stringify({
+        workspace: msg.payload.workspace,
+        owner: msg.payload.owner,
+        reason: msg.payload.reason,
+        ttl: msg.payload.ttl,
+        command: 'lock'
+      }));
+      return model;
+
+    case UNLOCK_WORKSPACE:
+      socket.send(JSON.stringify({
+        workspace: msg.payload.workspace,
+        owner: msg.payload.owner,
+        force: true,
+        command: 'unlock'
+      }));
+      return model;
+
     case CONNECTED:
       return Object.assign({}, model, {
         connection: SOCK_CONNECTED